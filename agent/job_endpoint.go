@@ -442,7 +442,9 @@ func ApiJobToStructJob(job *api.Job, trafficLimit int) *models.Job {
 		Name:              *job.Name,
 		Failover:          job.Failover,
 		Type:              *job.Type,
+		Priority:          *job.Priority,
 		Datacenters:       job.Datacenters,
+		Meta:              job.Meta,
 		Status:            *job.Status,
 		StatusDescription: *job.StatusDescription,
 		CreateIndex:       *job.CreateIndex,
@@ -187,8 +187,10 @@ type Job struct {
 	Name              *string
 	Failover          bool
 	Type              *string
+	Priority          *int
 	Datacenters       []string
 	Tasks             []*Task
+	Meta              map[string]string
 	Status            *string
 	StatusDescription *string
 	EnforceIndex      bool
@@ -213,6 +215,9 @@ func (j *Job) Canonicalize() {
 	if j.Type == nil {
 		j.Type = internal.StringToPtr(models.JobTypeSync)
 	}
+	if j.Priority == nil {
+		j.Priority = internal.IntToPtr(models.JobDefaultPriority)
+	}
 	if j.Status == nil {
 		j.Status = internal.StringToPtr("")
 	}
@@ -74,6 +74,7 @@ type Node struct {
 	HTTPAddr          string
 	Attributes        map[string]string
 	Meta              map[string]string
+	NodeClass         string
 	Status            string
 	StatusDescription string
 	StatusUpdatedAt   int64
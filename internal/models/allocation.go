@@ -59,9 +59,17 @@ type Allocation struct {
 	// Desired Status of the allocation on the client
 	DesiredStatus string
 
+	// PreviousDesiredStatus is the desired status the allocation had before
+	// it last changed
+	PreviousDesiredStatus string
+
 	// DesiredStatusDescription is meant to provide more human useful information
 	DesiredDescription string
 
+	// MaintenancePaused is set on allocations paused for cluster
+	// maintenance. Any explicit desired status change clears it.
+	MaintenancePaused bool
+
 	// Status of the allocation on the client
 	ClientStatus string
 
@@ -74,6 +82,10 @@ type Allocation struct {
 	// PreviousAllocation is the allocation that this allocation is replacing
 	PreviousAllocation string
 
+	// FollowupEvalID is the ID of the evaluation created to handle the
+	// failure of this allocation, if any
+	FollowupEvalID string
+
 	// Raft Indexes
 	CreateIndex uint64
 	ModifyIndex uint64
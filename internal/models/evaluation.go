@@ -40,6 +40,10 @@ type Evaluation struct {
 	// is assigned upon the creation of the evaluation.
 	ID string
 
+	// Priority is used to control scheduling importance and if this job
+	// can preempt other jobs.
+	Priority int
+
 	// Type is used to control which schedulers are available to handle
 	// this evaluation.
 	Type string
@@ -73,6 +77,10 @@ type Evaluation struct {
 	// support a rolling upgrade.
 	Wait time.Duration
 
+	// WaitUntil is the time before which the eval must not be dequeued.
+	// This is used to support delayed rescheduling.
+	WaitUntil time.Time
+
 	// NextEval is the evaluation ID for the eval created to do a followup.
 	// This is used to support rolling upgrades, where we need a chain of evaluations.
 	NextEval string
@@ -112,6 +120,13 @@ type Evaluation struct {
 	// scheduler.
 	SnapshotIndex uint64
 
+	// ProcessedBy is the ID of the scheduler worker that acknowledged the
+	// evaluation. It is empty until the evaluation has been acked.
+	ProcessedBy string
+
+	// AckIndex is the Raft index at which the evaluation was acknowledged
+	AckIndex uint64
+
 	// Raft Indexes
 	CreateIndex uint64
 	ModifyIndex uint64
@@ -211,6 +226,7 @@ func (e *Evaluation) MakePlan(j *Job) *Plan {
 func (e *Evaluation) NextRollingEval(wait time.Duration) *Evaluation {
 	return &Evaluation{
 		ID:             GenerateUUID(),
+		Priority:       e.Priority,
 		Type:           e.Type,
 		TriggeredBy:    EvalTriggerRollingUpdate,
 		JobID:          e.JobID,
@@ -227,6 +243,7 @@ func (e *Evaluation) NextRollingEval(wait time.Duration) *Evaluation {
 func (e *Evaluation) CreateBlockedEval(classEligibility map[string]bool, escaped bool) *Evaluation {
 	return &Evaluation{
 		ID:                   GenerateUUID(),
+		Priority:             e.Priority,
 		Type:                 e.Type,
 		TriggeredBy:          e.TriggeredBy,
 		JobID:                e.JobID,
@@ -20,6 +20,11 @@ const (
 	JobTypeSync = "synchronous"
 )
 
+const (
+	// JobDefaultPriority is the default priority if not specified
+	JobDefaultPriority = 50
+)
+
 const (
 	JobStatusPause    = "pause"    // Pause means the job is pause
 	JobStatusPending  = "pending"  // Pending means the job is waiting on scheduling
@@ -63,6 +68,10 @@ type Job struct {
 	// This can be extended in the future to support custom schedulers.
 	Type string
 
+	// Priority is used to control scheduling importance. Higher values are
+	// more important.
+	Priority int
+
 	// Datacenters contains all the datacenters this job is allowed to span
 	Datacenters []string
 
@@ -74,12 +83,23 @@ type Job struct {
 	// to run. Each task is an atomic unit of scheduling and placement.
 	Tasks []*Task
 
+	// Meta is used to associate arbitrary metadata with this job, such as
+	// the source cluster it replicates from.
+	Meta map[string]string
+
 	// Job status
 	Status string
 
 	// StatusDescription is meant to provide more human useful information
 	StatusDescription string
 
+	// MaintenancePaused is set on jobs paused for cluster maintenance, as
+	// opposed to paused by a user. Any explicit status change clears it.
+	MaintenancePaused bool
+
+	// SubmitTime is the time at which the job was submitted as a UnixNano
+	SubmitTime int64
+
 	EnforceIndex bool
 
 	// Raft Indexes
@@ -91,6 +111,9 @@ type Job struct {
 // Canonicalize is used to canonicalize fields in the Job. This should be called
 // when registering a Job.
 func (j *Job) Canonicalize() {
+	if j.Priority == 0 {
+		j.Priority = JobDefaultPriority
+	}
 	for _, t := range j.Tasks {
 		t.Canonicalize(j)
 	}
@@ -106,6 +129,7 @@ func (j *Job) Copy() *Job {
 	*nj = *j
 	nj.Datacenters = internal.CopySliceString(nj.Datacenters)
 	nj.Constraints = CopySliceConstraints(nj.Constraints)
+	nj.Meta = internal.CopyMapStringString(nj.Meta)
 
 	if j.Tasks != nil {
 		ts := make([]*Task, len(nj.Tasks))
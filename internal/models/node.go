@@ -76,8 +76,17 @@ type NodeServerInfo struct {
 // NodeUpdateStatusRequest is used for Node.UpdateStatus endpoint
 // to update the status of a node.
 type NodeUpdateStatusRequest struct {
-	NodeID string
-	Status string
+	NodeID    string
+	Status    string
+	UpdatedAt int64
+	WriteRequest
+}
+
+// NodeUpdateHeartbeatRequest is used by the Node.UpdateStatus endpoint to
+// record a heartbeat that doesn't change the status of a node.
+type NodeUpdateHeartbeatRequest struct {
+	NodeID    string
+	UpdatedAt int64
 	WriteRequest
 }
 
@@ -182,6 +191,10 @@ type Node struct {
 	// "docker.runtime=1.8.3"
 	Attributes map[string]string
 
+	// NodeClass is an opaque identifier used to group nodes by the role
+	// they play, such as "extract" or "apply".
+	NodeClass string
+
 	// ComputedClass is a unique id that identifies nodes with a common set of
 	// attributes and capabilities.
 	ComputedClass string
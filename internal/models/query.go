@@ -39,6 +39,7 @@ const (
 	EvalDeleteRequestType
 	AllocUpdateRequestType
 	AllocClientUpdateRequestType
+	NodeUpdateHeartbeatRequestType
 )
 
 const (
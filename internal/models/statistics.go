@@ -87,3 +87,14 @@ type TaskStatistics struct {
 type AllocStatistics struct {
 	Tasks map[string]*TaskStatistics
 }
+
+// AllocStats holds the latest statistics reported for an allocation. They
+// are stored apart from the allocation so frequent reports don't rewrite it.
+type AllocStats struct {
+	AllocID string
+	Stats   *AllocStatistics
+
+	// Raft Indexes
+	CreateIndex uint64
+	ModifyIndex uint64
+}
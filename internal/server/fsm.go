@@ -41,6 +41,7 @@ const (
 	EvalSnapshot
 	AllocSnapshot
 	TimeTableSnapshot
+	AllocStatsSnapshot
 )
 
 // udupFSM implements a finite store machine that is used
@@ -69,10 +70,6 @@ type udupSnapshot struct {
 	timetable *TimeTable
 }
 
-// snapshotHeader is the first entry in our snapshot
-type snapshotHeader struct {
-}
-
 // NewFSMPath is used to construct a new FSM with a blank store
 func NewFSM(evalBroker *EvalBroker,
 	blocked *BlockedEvals, logOutput io.Writer, logger *log.Logger) (*udupFSM, error) {
@@ -133,6 +130,8 @@ func (n *udupFSM) Apply(log *raft.Log) interface{} {
 		return n.applyDeregisterNode(buf[1:], log.Index)
 	case models.NodeUpdateStatusRequestType:
 		return n.applyStatusUpdate(buf[1:], log.Index)
+	case models.NodeUpdateHeartbeatRequestType:
+		return n.applyNodeHeartbeat(buf[1:], log.Index)
 	case models.JobUpdateStatusRequestType:
 		return n.applyJobStatusUpdate(buf[1:], log.Index)
 	case models.JobRegisterRequestType:
@@ -200,6 +199,20 @@ func (n *udupFSM) applyDeregisterNode(buf []byte, index uint64) interface{} {
 	return nil
 }
 
+func (n *udupFSM) applyNodeHeartbeat(buf []byte, index uint64) interface{} {
+	defer metrics.MeasureSince([]string{"server", "fsm", "node_heartbeat"}, time.Now())
+	var req models.NodeUpdateHeartbeatRequest
+	if err := models.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	if err := n.state.UpdateNodeHeartbeat(index, req.NodeID, time.Unix(req.UpdatedAt, 0)); err != nil {
+		n.logger.Errorf("server.fsm: UpdateNodeHeartbeat failed: %v", err)
+		return err
+	}
+	return nil
+}
+
 func (n *udupFSM) applyStatusUpdate(buf []byte, index uint64) interface{} {
 	defer metrics.MeasureSince([]string{"server", "fsm", "node_status_update"}, time.Now())
 	var req models.NodeUpdateStatusRequest
@@ -207,7 +220,7 @@ func (n *udupFSM) applyStatusUpdate(buf []byte, index uint64) interface{} {
 		panic(fmt.Errorf("failed to decode request: %v", err))
 	}
 
-	if err := n.state.UpdateNodeStatus(index, req.NodeID, req.Status); err != nil {
+	if err := n.state.UpdateNodeStatus(index, req.NodeID, req.Status, req.UpdatedAt); err != nil {
 		n.logger.Errorf("server.fsm: UpdateNodeStatus failed: %v", err)
 		return err
 	}
@@ -628,7 +641,7 @@ func (n *udupFSM) Restore(old io.ReadCloser) error {
 	dec := codec.NewDecoder(old, models.MsgpackHandle)
 
 	// Read in the header
-	var header snapshotHeader
+	var header store.SnapshotMeta
 	if err := dec.Decode(&header); err != nil {
 		return err
 	}
@@ -690,6 +703,15 @@ func (n *udupFSM) Restore(old io.ReadCloser) error {
 				return err
 			}
 
+		case AllocStatsSnapshot:
+			stats := new(models.AllocStats)
+			if err := dec.Decode(stats); err != nil {
+				return err
+			}
+			if err := restore.AllocStatsRestore(stats); err != nil {
+				return err
+			}
+
 		case IndexSnapshot:
 			idx := new(store.IndexEntry)
 			if err := dec.Decode(idx); err != nil {
@@ -704,6 +726,9 @@ func (n *udupFSM) Restore(old io.ReadCloser) error {
 		}
 	}
 
+	if err := restore.EnsureIndexes(); err != nil {
+		return err
+	}
 	restore.Commit()
 
 	// External code might be calling State(), so we need to synchronize
@@ -721,13 +746,29 @@ func (n *udupFSM) Restore(old io.ReadCloser) error {
 	return nil
 }
 
+// Persist streams the snapshot to the sink one object at a time, so memory
+// use doesn't grow with the size of the store. The stream is a msgpack
+// encoded store.SnapshotMeta header, which store.ReadSnapshotMeta can peek,
+// followed by the time table and then every index, node, job, eval, alloc
+// and alloc stats row in turn. Each of those records is a single
+// SnapshotType byte followed by the msgpack encoding of the object. Restore
+// reads the records back in the same way.
 func (s *udupSnapshot) Persist(sink raft.SnapshotSink) error {
 	defer metrics.MeasureSince([]string{"server", "fsm", "persist"}, time.Now())
 	// Register the nodes
 	encoder := codec.NewEncoder(sink, models.MsgpackHandle)
 
 	// Write the header
-	header := snapshotHeader{}
+	index, err := s.snap.LatestIndex()
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	header := store.SnapshotMeta{
+		Index:         index,
+		CreatedAt:     time.Now().UTC(),
+		SchemaVersion: store.SnapshotSchemaVersion,
+	}
 	if err := encoder.Encode(&header); err != nil {
 		sink.Cancel()
 		return err
@@ -761,6 +802,10 @@ func (s *udupSnapshot) Persist(sink raft.SnapshotSink) error {
 		sink.Cancel()
 		return err
 	}
+	if err := s.persistAllocStats(sink, encoder); err != nil {
+		sink.Cancel()
+		return err
+	}
 
 	return nil
 }
@@ -904,6 +949,31 @@ func (s *udupSnapshot) persistAllocs(sink raft.SnapshotSink,
 	return nil
 }
 
+func (s *udupSnapshot) persistAllocStats(sink raft.SnapshotSink,
+	encoder *codec.Encoder) error {
+	// Get all the allocation statistics
+	ws := memdb.NewWatchSet()
+	stats, err := s.snap.AllAllocStats(ws)
+	if err != nil {
+		return err
+	}
+
+	for {
+		// Get the next item
+		raw := stats.Next()
+		if raw == nil {
+			break
+		}
+
+		// Write out the statistics
+		sink.Write([]byte{byte(AllocStatsSnapshot)})
+		if err := encoder.Encode(raw.(*models.AllocStats)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Release is a no-op, as we just need to GC the pointer
 // to the store store snapshot. There is nothing to explicitly
 // cleanup.
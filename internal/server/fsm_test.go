@@ -8,13 +8,20 @@ package server
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
+
 	log "github.com/actiontech/dtle/internal/logger"
+	"github.com/actiontech/dtle/internal/models"
 	"github.com/actiontech/dtle/internal/server/store"
 
+	memdb "github.com/hashicorp/go-memdb"
 	"github.com/hashicorp/raft"
 	"github.com/ugorji/go/codec"
 )
@@ -745,6 +752,86 @@ func Test_udupSnapshot_Persist(t *testing.T) {
 	}
 }
 
+// countingSink is a raft.SnapshotSink that records the size of every write
+type countingSink struct {
+	w        io.Writer
+	total    int
+	maxWrite int
+}
+
+func (s *countingSink) Write(p []byte) (int, error) {
+	s.total += len(p)
+	if len(p) > s.maxWrite {
+		s.maxWrite = len(p)
+	}
+	return s.w.Write(p)
+}
+
+func (s *countingSink) Close() error  { return nil }
+func (s *countingSink) ID() string    { return "counting" }
+func (s *countingSink) Cancel() error { return nil }
+
+func Test_udupSnapshot_Persist_Streams(t *testing.T) {
+	fsm, err := NewFSM(nil, nil, os.Stderr, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Each node carries an attribute far larger than the rest of it
+	const attrSize = 4096
+	const numNodes = 200
+	for i := 0; i < numNodes; i++ {
+		node := &models.Node{
+			ID:         models.GenerateUUID(),
+			Datacenter: "dc1",
+			Name:       fmt.Sprintf("node-%d", i),
+			Attributes: map[string]string{"blob": strings.Repeat("x", attrSize)},
+			Status:     models.NodeStatusReady,
+		}
+		if err := fsm.State().UpsertNode(uint64(1000+i), node); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var buf bytes.Buffer
+	sink := &countingSink{w: &buf}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The objects reach the sink piecewise rather than as one large buffer
+	if sink.total < numNodes*attrSize {
+		t.Fatalf("short snapshot: %d bytes", sink.total)
+	}
+	if sink.maxWrite > 2*attrSize {
+		t.Fatalf("snapshot buffered: largest write is %d of %d bytes", sink.maxWrite, sink.total)
+	}
+
+	// The stream restores into an equivalent store
+	restored, err := NewFSM(nil, nil, os.Stderr, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := restored.Restore(ioutil.NopCloser(&buf)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	iter, err := restored.State().Nodes(memdb.NewWatchSet())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	count := 0
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		count++
+	}
+	if count != numNodes {
+		t.Fatalf("restored %d nodes, want %d", count, numNodes)
+	}
+}
+
 func Test_udupSnapshot_persistIndexes(t *testing.T) {
 	type fields struct {
 		snap      *store.StateSnapshot
@@ -84,6 +84,9 @@ func (j *Job) Register(args *models.JobRegisterRequest, reply *models.JobRespons
 		}
 	}
 
+	// Record when the job was submitted
+	args.Job.SubmitTime = time.Now().UnixNano()
+
 	// Commit this update via Raft
 	_, index, err := j.srv.raftApply(models.JobRegisterRequestType, args)
 	if err != nil {
@@ -95,6 +98,7 @@ func (j *Job) Register(args *models.JobRegisterRequest, reply *models.JobRespons
 	// Create a new evaluation
 	eval := &models.Evaluation{
 		ID:             models.GenerateUUID(),
+		Priority:       args.Job.Priority,
 		Type:           args.Job.Type,
 		TriggeredBy:    models.EvalTriggerJobRegister,
 		JobID:          args.Job.ID,
@@ -210,6 +214,7 @@ func (j *Job) UpdateStatus(args *models.JobUpdateStatusRequest, reply *models.Jo
 		// Create a new evaluation
 		eval := &models.Evaluation{
 			ID:             models.GenerateUUID(),
+			Priority:       job.Priority,
 			Type:           job.Type,
 			TriggeredBy:    triggeredBy,
 			JobID:          args.JobID,
@@ -309,6 +314,7 @@ func (j *Job) Evaluate(args *models.JobEvaluateRequest, reply *models.JobRespons
 	// Create a new evaluation
 	eval := &models.Evaluation{
 		ID:             models.GenerateUUID(),
+		Priority:       job.Priority,
 		Type:           job.Type,
 		TriggeredBy:    models.EvalTriggerJobRegister,
 		JobID:          job.ID,
@@ -347,6 +353,21 @@ func (j *Job) Deregister(args *models.JobDeregisterRequest, reply *models.JobRes
 		return fmt.Errorf("missing job ID for evaluation")
 	}
 
+	// Lookup the job so the evaluation can inherit its priority
+	snap, err := j.srv.fsm.State().Snapshot()
+	if err != nil {
+		return err
+	}
+	ws := memdb.NewWatchSet()
+	job, err := snap.JobByID(ws, args.JobID)
+	if err != nil {
+		return err
+	}
+	priority := models.JobDefaultPriority
+	if job != nil {
+		priority = job.Priority
+	}
+
 	// Commit this update via Raft
 	_, index, err := j.srv.raftApply(models.JobDeregisterRequestType, args)
 	if err != nil {
@@ -356,11 +377,12 @@ func (j *Job) Deregister(args *models.JobDeregisterRequest, reply *models.JobRes
 	}
 
 	// Create a new evaluation
-	// XXX: The job priority / type is strange for this, since it's not a high
-	// priority even if the job was. The scheduler itself also doesn't matter,
-	// since all should be able to handle deregistration in the same way.
+	// XXX: The job type is strange for this, but the scheduler doesn't
+	// matter, since all should be able to handle deregistration in the same
+	// way.
 	eval := &models.Evaluation{
 		ID:             models.GenerateUUID(),
+		Priority:       priority,
 		Type:           models.JobTypeSync,
 		TriggeredBy:    models.EvalTriggerJobDeregister,
 		JobID:          args.JobID,
@@ -616,6 +638,7 @@ func (j *Job) Plan(args *models.JobPlanRequest, reply *models.JobPlanResponse) e
 	// Create an eval and mark it as requiring annotations and insert that as well
 	eval := &models.Evaluation{
 		ID:             models.GenerateUUID(),
+		Priority:       args.Job.Priority,
 		Type:           args.Job.Type,
 		TriggeredBy:    models.EvalTriggerJobRegister,
 		JobID:          args.Job.ID,
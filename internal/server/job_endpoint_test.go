@@ -304,7 +304,7 @@ func Test_validateJob(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := validateJob(tt.args.job); (err != nil) != tt.wantErr {
+			if err := tt.args.job.Validate(); (err != nil) != tt.wantErr {
 				t.Errorf("validateJob() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -26,6 +26,11 @@ const (
 	// maxParallelRequestsPerDerive  is the maximum number of parallel Vault
 	// create token requests that may be outstanding per derive request
 	maxParallelRequestsPerDerive = 16
+
+	// heartbeatPersistInterval is how stale the persisted StatusUpdatedAt of
+	// a node may get before a heartbeat that keeps its status is committed
+	// via Raft. Heartbeats in between are not written at all.
+	heartbeatPersistInterval = 5 * time.Minute
 )
 
 // Node endpoint is used for client interactions
@@ -246,7 +251,10 @@ func (n *Node) UpdateStatus(args *models.NodeUpdateStatusRequest, reply *models.
 	}
 
 	// Update the timestamp of when the node status was updated
-	node.StatusUpdatedAt = time.Now().Unix()
+	now := time.Now()
+	persistedAt := time.Unix(node.StatusUpdatedAt, 0)
+	node.StatusUpdatedAt = now.Unix()
+	args.UpdatedAt = node.StatusUpdatedAt
 
 	// Commit this update via Raft
 	var index uint64
@@ -257,6 +265,18 @@ func (n *Node) UpdateStatus(args *models.NodeUpdateStatusRequest, reply *models.
 			return err
 		}
 		reply.NodeModifyIndex = index
+	} else if now.Sub(persistedAt) > heartbeatPersistInterval {
+		// Refresh the persisted heartbeat only once it gets stale, so that
+		// heartbeats don't churn the Raft log and the nodes index.
+		req := &models.NodeUpdateHeartbeatRequest{
+			NodeID:       args.NodeID,
+			UpdatedAt:    node.StatusUpdatedAt,
+			WriteRequest: args.WriteRequest,
+		}
+		if _, _, err := n.srv.raftApply(models.NodeUpdateHeartbeatRequestType, req); err != nil {
+			n.srv.logger.Errorf("server.agent: heartbeat update failed: %v", err)
+			return err
+		}
 	}
 
 	// Check if we should trigger evaluations
@@ -694,6 +714,7 @@ func (n *Node) createNodeEvals(nodeID string, nodeIndex uint64) ([]string, uint6
 		// Create a new eval
 		eval := &models.Evaluation{
 			ID:              models.GenerateUUID(),
+			Priority:        alloc.Job.Priority,
 			Type:            alloc.Job.Type,
 			TriggeredBy:     models.EvalTriggerNodeUpdate,
 			JobID:           alloc.JobID,
@@ -716,6 +737,7 @@ func (n *Node) createNodeEvals(nodeID string, nodeIndex uint64) ([]string, uint6
 		// Create a new eval
 		eval := &models.Evaluation{
 			ID:              models.GenerateUUID(),
+			Priority:        job.Priority,
 			Type:            job.Type,
 			TriggeredBy:     models.EvalTriggerNodeUpdate,
 			JobID:           job.ID,
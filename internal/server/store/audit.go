@@ -0,0 +1,131 @@
+/*
+ * Copyright (C) 2016-2018. ActionTech.
+ * Based on: github.com/hashicorp/nomad, github.com/github/gh-ost .
+ * License: MPL version 2: https://www.mozilla.org/en-US/MPL/2.0 .
+ */
+
+package store
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/go-memdb"
+)
+
+const (
+	// defaultAuditLogSize is the number of mutations kept by the audit log
+	defaultAuditLogSize = 1024
+)
+
+// AuditEntry describes a single mutation applied to the state store. Key
+// is empty for mutations that replace a whole table.
+type AuditEntry struct {
+	Method string
+	Table  string
+	Key    string
+	Index  uint64
+}
+
+// auditLog is a bounded ring buffer of the most recent mutations. Entries
+// are staged per write transaction and only become visible once the
+// transaction commits, so aborted writes are never recorded.
+type auditLog struct {
+	l       sync.RWMutex
+	entries []AuditEntry
+	next    int
+	full    bool
+
+	// pendingTxn and pending hold the entries of the write transaction in
+	// flight. MemDB serializes writers so these need no locking.
+	pendingTxn *memdb.Txn
+	pending    *[]AuditEntry
+}
+
+func newAuditLog(size int) *auditLog {
+	return &auditLog{
+		entries: make([]AuditEntry, size),
+	}
+}
+
+// record stages an entry for the given write transaction
+func (a *auditLog) record(txn *memdb.Txn, entry AuditEntry) {
+	if a.pendingTxn != txn {
+		// Entries left over from an aborted transaction are dropped here.
+		// Deferred functions run after MemDB releases the writer lock, so
+		// each transaction flushes its own staging slice.
+		staged := new([]AuditEntry)
+		a.pendingTxn = txn
+		a.pending = staged
+		txn.Defer(func() { a.flush(*staged) })
+	}
+	*a.pending = append(*a.pending, entry)
+}
+
+// flush moves committed entries into the ring buffer. It runs after the
+// writer lock is released, so concurrent commits may flush out of index
+// order; recent sorts the entries by index to hide this.
+func (a *auditLog) flush(staged []AuditEntry) {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	for _, entry := range staged {
+		a.entries[a.next] = entry
+		a.next++
+		if a.next == len(a.entries) {
+			a.next = 0
+			a.full = true
+		}
+	}
+}
+
+// recent returns up to n of the latest entries in index order. Entries of
+// the same index keep the order they were recorded in.
+func (a *auditLog) recent(n int) []AuditEntry {
+	a.l.RLock()
+	size := a.next
+	if a.full {
+		size = len(a.entries)
+	}
+	out := make([]AuditEntry, 0, size)
+	start := a.next - size
+	if start < 0 {
+		start += len(a.entries)
+	}
+	for i := 0; i < size; i++ {
+		out = append(out, a.entries[(start+i)%len(a.entries)])
+	}
+	a.l.RUnlock()
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Index < out[j].Index
+	})
+	if n > 0 && n < len(out) {
+		out = out[len(out)-n:]
+	}
+	return out
+}
+
+// audit records a mutation against the state store. It is a no-op on
+// snapshots, which never mutate.
+func (s *StateStore) audit(txn *memdb.Txn, method, table, key string, index uint64) {
+	if s.auditLog == nil {
+		return
+	}
+	s.auditLog.record(txn, AuditEntry{
+		Method: method,
+		Table:  table,
+		Key:    key,
+		Index:  index,
+	})
+}
+
+// RecentMutations returns up to n of the most recent mutations applied to
+// the state store, ordered by index. A non-positive n returns all retained
+// entries.
+func (s *StateStore) RecentMutations(n int) []AuditEntry {
+	if s.auditLog == nil {
+		return nil
+	}
+	return s.auditLog.recent(n)
+}
@@ -29,6 +29,7 @@ func stateStoreSchema() *memdb.DBSchema {
 		orderTableSchema,
 		evalTableSchema,
 		allocTableSchema,
+		allocStatsTableSchema,
 	}
 
 	// Add each of the tables
@@ -77,6 +78,17 @@ func nodeTableSchema() *memdb.TableSchema {
 					Field: "ID",
 				},
 			},
+
+			// Class is used to lookup nodes by their node class. Nodes
+			// without a class are left out of the index.
+			"class": {
+				Name:         "class",
+				AllowMissing: true,
+				Unique:       false,
+				Indexer: &memdb.StringFieldIndex{
+					Field: "NodeClass",
+				},
+			},
 		},
 	}
 }
@@ -108,6 +120,18 @@ func jobTableSchema() *memdb.TableSchema {
 					Lowercase: false,
 				},
 			},
+
+			// Meta indexes every key/value pair of the job's metadata.
+			// Jobs without metadata are left out of the index.
+			"meta": {
+				Name:         "meta",
+				AllowMissing: true,
+				Unique:       false,
+				Indexer: &memdb.StringMapFieldIndex{
+					Field:     "Meta",
+					Lowercase: false,
+				},
+			},
 		},
 	}
 }
@@ -167,6 +191,29 @@ func evalTableSchema() *memdb.TableSchema {
 					},
 				},
 			},
+
+			// Status index is used to lookup evaluations by status
+			"status": {
+				Name:         "status",
+				AllowMissing: false,
+				Unique:       false,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "Status",
+					Lowercase: true,
+				},
+			},
+
+			// Trigger index is used to lookup evaluations by what
+			// triggered them
+			"trigger": {
+				Name:         "trigger",
+				AllowMissing: true,
+				Unique:       false,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "TriggeredBy",
+					Lowercase: true,
+				},
+			},
 		},
 	}
 }
@@ -228,6 +275,18 @@ func allocTableSchema() *memdb.TableSchema {
 				},
 			},
 
+			// Client status index is used to lookup allocations by the
+			// status reported by the client
+			"client_status": {
+				Name:         "client_status",
+				AllowMissing: true,
+				Unique:       false,
+				Indexer: &memdb.StringFieldIndex{
+					Field:     "ClientStatus",
+					Lowercase: true,
+				},
+			},
+
 			// Eval index is used to lookup allocations by eval
 			"eval": {
 				Name:         "eval",
@@ -240,3 +299,22 @@ func allocTableSchema() *memdb.TableSchema {
 		},
 	}
 }
+
+// allocStatsTableSchema returns the MemDB schema for the allocation stats
+// table. This table is used to store the latest statistics reported for
+// each allocation, keyed by the allocation ID.
+func allocStatsTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "alloc_stats",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": {
+				Name:         "id",
+				AllowMissing: false,
+				Unique:       true,
+				Indexer: &memdb.UUIDFieldIndex{
+					Field: "AllocID",
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2016-2018. ActionTech.
+ * Based on: github.com/hashicorp/nomad, github.com/github/gh-ost .
+ * License: MPL version 2: https://www.mozilla.org/en-US/MPL/2.0 .
+ */
+
+package store
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ugorji/go/codec"
+
+	"github.com/actiontech/dtle/internal/models"
+)
+
+const (
+	// SnapshotSchemaVersion is the version of the persisted snapshot format.
+	// Snapshots written before the header carried any metadata read back
+	// as version 0.
+	SnapshotSchemaVersion = 1
+)
+
+// SnapshotMeta is the header at the start of every persisted snapshot. It
+// lets consumers tell when and at which index a snapshot was taken without
+// decoding the whole stream.
+type SnapshotMeta struct {
+	// Index is the latest index in the state store when the snapshot
+	// was taken
+	Index uint64
+
+	// CreatedAt is the time the snapshot was written
+	CreatedAt time.Time
+
+	// SchemaVersion is the format version of the snapshot
+	SchemaVersion int
+}
+
+// ReadSnapshotMeta decodes the header at the start of a persisted snapshot.
+// Only the header is consumed from r, so the rest of the snapshot can still
+// be read from it.
+func ReadSnapshotMeta(r io.Reader) (*SnapshotMeta, error) {
+	var meta SnapshotMeta
+	if err := codec.NewDecoder(r, models.MsgpackHandle).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("snapshot header decode failed: %v", err)
+	}
+	return &meta, nil
+}
+
+// snapshotCache holds a recently taken snapshot so that concurrent callers
+// can share it
+type snapshotCache struct {
+	l     sync.Mutex
+	snap  *StateSnapshot
+	taken time.Time
+}
+
+// CachedSnapshot returns the snapshot last taken through it if it is no
+// older than maxAge, and takes a fresh one otherwise. Callers within the
+// same window share the snapshot, so they must treat it as read-only like
+// any other snapshot.
+func (s *StateStore) CachedSnapshot(maxAge time.Duration) (*StateSnapshot, error) {
+	c := s.snapshotCache
+	if c == nil {
+		return s.Snapshot()
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	now := time.Now()
+	if c.snap != nil && now.Sub(c.taken) <= maxAge {
+		return c.snap, nil
+	}
+
+	snap, err := s.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	c.snap = snap
+	c.taken = now
+	return snap, nil
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2016-2018. ActionTech.
+ * Based on: github.com/hashicorp/nomad, github.com/github/gh-ost .
+ * License: MPL version 2: https://www.mozilla.org/en-US/MPL/2.0 .
+ */
+
+package store
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ugorji/go/codec"
+
+	"github.com/actiontech/dtle/internal/models"
+)
+
+func TestReadSnapshotMeta(t *testing.T) {
+	meta := &SnapshotMeta{
+		Index:         1234,
+		CreatedAt:     time.Unix(1500000000, 0).UTC(),
+		SchemaVersion: SnapshotSchemaVersion,
+	}
+
+	// A header followed by a record, as written by Persist
+	var buf bytes.Buffer
+	encoder := codec.NewEncoder(&buf, models.MsgpackHandle)
+	if err := encoder.Encode(meta); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf.WriteByte(42)
+
+	out, err := ReadSnapshotMeta(&buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Index != meta.Index || !out.CreatedAt.Equal(meta.CreatedAt) || out.SchemaVersion != meta.SchemaVersion {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Only the header was consumed
+	if b, err := buf.ReadByte(); err != nil || b != 42 {
+		t.Fatalf("bad: %v %v", b, err)
+	}
+
+	// Snapshots written with the old empty header read as version 0
+	buf.Reset()
+	if err := encoder.Encode(struct{}{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err = ReadSnapshotMeta(&buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.SchemaVersion != 0 || out.Index != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	if _, err := ReadSnapshotMeta(bytes.NewReader(nil)); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestStateStore_CachedSnapshot(t *testing.T) {
+	state := testStateStore(t)
+	if err := state.UpsertNode(1000, testNode()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	first, err := state.CachedSnapshot(time.Hour)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertNode(1001, testNode()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	second, err := state.CachedSnapshot(time.Hour)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if first != second {
+		t.Fatalf("expected the cached snapshot")
+	}
+	if index, _ := second.Index("nodes"); index != 1000 {
+		t.Fatalf("bad index: %d", index)
+	}
+
+	// Once the snapshot is older than maxAge a fresh one is taken
+	time.Sleep(10 * time.Millisecond)
+	third, err := state.CachedSnapshot(5 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if third == second {
+		t.Fatalf("expected a fresh snapshot")
+	}
+	if index, _ := third.Index("nodes"); index != 1001 {
+		t.Fatalf("bad index: %d", index)
+	}
+}
@@ -7,16 +7,31 @@
 package store
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"reflect"
+	"sort"
 	"strconv"
+	"time"
 
 	"github.com/hashicorp/go-memdb"
+	"github.com/ugorji/go/codec"
 
 	"github.com/actiontech/dtle/internal/models"
 )
 
+const (
+	// maintenancePauseDesc is the status description of jobs and
+	// allocations paused by PauseAllJobs. It is informational only; the
+	// MaintenancePaused flag tells them apart from jobs a user paused.
+	maintenancePauseDesc = "paused for cluster maintenance"
+)
+
 // IndexEntry is used with the "index" table
 // for managing the latest Raft index affecting a table.
 type IndexEntry struct {
@@ -38,6 +53,17 @@ type StateStore struct {
 	// abandonCh is used to signal watchers that this state store has been
 	// abandoned (usually during a restore). This is only ever closed.
 	abandonCh chan struct{}
+
+	// auditLog keeps the most recent mutations for inspection
+	auditLog *auditLog
+
+	// snapshotCache holds the snapshot handed out by CachedSnapshot
+	snapshotCache *snapshotCache
+
+	// CopyOnRead makes the lookups by ID return copies of the stored
+	// objects, so callers that mutate them by accident can't corrupt the
+	// state store. It is off by default as copying has a cost.
+	CopyOnRead bool
 }
 
 // NewStateStore is used to create a new state store
@@ -50,9 +76,11 @@ func NewStateStore(logOutput io.Writer) (*StateStore, error) {
 
 	// Create the state store
 	s := &StateStore{
-		logger:    log.New(logOutput, "", log.LstdFlags|log.Lmicroseconds),
-		db:        db,
-		abandonCh: make(chan struct{}),
+		logger:        log.New(logOutput, "", log.LstdFlags|log.Lmicroseconds),
+		db:            db,
+		abandonCh:     make(chan struct{}),
+		auditLog:      newAuditLog(defaultAuditLogSize),
+		snapshotCache: &snapshotCache{},
 	}
 	return s, nil
 }
@@ -61,11 +89,82 @@ func NewStateStore(logOutput io.Writer) (*StateStore, error) {
 // we use MemDB, we just need to snapshot the state of the underlying
 // database.
 func (s *StateStore) Snapshot() (*StateSnapshot, error) {
+	db := s.db.Snapshot()
+	index, err := latestIndex(db.Txn(false))
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &StateSnapshot{
+		StateStore: StateStore{
+			logger:     s.logger,
+			db:         db,
+			CopyOnRead: s.CopyOnRead,
+		},
+		index: index,
+	}
+	return snap, nil
+}
+
+// PartialSnapshot is used to create a point in time snapshot holding only
+// the named tables, along with their entries in the index table. All other
+// tables are empty, which makes the snapshot cheaper to walk and serialize.
+func (s *StateStore) PartialSnapshot(tables []string) (*StateSnapshot, error) {
+	schema := stateStoreSchema()
+	for _, table := range tables {
+		if _, ok := schema.Tables[table]; !ok {
+			return nil, fmt.Errorf("unknown table %q", table)
+		}
+	}
+
+	db, err := memdb.NewMemDB(schema)
+	if err != nil {
+		return nil, fmt.Errorf("state store setup failed: %v", err)
+	}
+
+	src := s.db.Snapshot().Txn(false)
+	dst := db.Txn(true)
+	defer dst.Abort()
+
+	// Record the index of the whole store, not just the copied tables
+	index, err := latestIndex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, table := range tables {
+		iter, err := src.Get(table, "id")
+		if err != nil {
+			return nil, fmt.Errorf("%s lookup failed: %v", table, err)
+		}
+		for raw := iter.Next(); raw != nil; raw = iter.Next() {
+			if err := dst.Insert(table, raw); err != nil {
+				return nil, fmt.Errorf("%s insert failed: %v", table, err)
+			}
+		}
+
+		if table == "index" {
+			continue
+		}
+		idx, err := src.First("index", "id", table)
+		if err != nil {
+			return nil, fmt.Errorf("index lookup failed: %v", err)
+		}
+		if idx != nil {
+			if err := dst.Insert("index", idx); err != nil {
+				return nil, fmt.Errorf("index insert failed: %v", err)
+			}
+		}
+	}
+	dst.Commit()
+
 	snap := &StateSnapshot{
 		StateStore: StateStore{
-			logger: s.logger,
-			db:     s.db.Snapshot(),
+			logger:     s.logger,
+			db:         db,
+			CopyOnRead: s.CopyOnRead,
 		},
+		index: index,
 	}
 	return snap, nil
 }
@@ -81,6 +180,135 @@ func (s *StateStore) Restore() (*StateRestore, error) {
 	return r, nil
 }
 
+// RestoreTable replaces the contents of a single table with objs in one
+// transaction, leaving every other table untouched. Each object must be of
+// the type stored in the table. The table's index is raised to the greatest
+// ModifyIndex among the restored rows, so blocking queries observe the change.
+func (s *StateStore) RestoreTable(table string, objs []interface{}) error {
+	for _, obj := range objs {
+		if err := validateTableObject(table, obj); err != nil {
+			return err
+		}
+	}
+
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	if _, err := txn.DeleteAll(table, "id"); err != nil {
+		return fmt.Errorf("%s delete failed: %v", table, err)
+	}
+
+	var max uint64
+	for _, obj := range objs {
+		if err := txn.Insert(table, obj); err != nil {
+			return fmt.Errorf("%s insert failed: %v", table, err)
+		}
+		if modify, ok := modifyIndexOf(obj); ok && modify > max {
+			max = modify
+		}
+	}
+	// The whole table is replaced, so record a single keyless entry
+	s.audit(txn, "RestoreTable", table, "", max)
+
+	if table != "index" && max != 0 {
+		existing, err := txn.First("index", "id", table)
+		if err != nil {
+			return fmt.Errorf("index lookup failed: %v", err)
+		}
+		if existing == nil || existing.(*IndexEntry).Value < max {
+			if err := txn.Insert("index", &IndexEntry{table, max}); err != nil {
+				return fmt.Errorf("index update failed: %v", err)
+			}
+		}
+	}
+
+	txn.Commit()
+	return nil
+}
+
+// validateTableObject checks that obj is of the type stored in table
+func validateTableObject(table string, obj interface{}) error {
+	ok := false
+	switch table {
+	case "index":
+		_, ok = obj.(*IndexEntry)
+	case "nodes":
+		_, ok = obj.(*models.Node)
+	case "jobs":
+		_, ok = obj.(*models.Job)
+	case "orders":
+		_, ok = obj.(*models.Order)
+	case "evals":
+		_, ok = obj.(*models.Evaluation)
+	case "allocs":
+		_, ok = obj.(*models.Allocation)
+	case "alloc_stats":
+		_, ok = obj.(*models.AllocStats)
+	default:
+		return fmt.Errorf("unknown table %q", table)
+	}
+	if !ok {
+		return fmt.Errorf("table %q can not store %T", table, obj)
+	}
+	return nil
+}
+
+// jsonDump mirrors the object written by StateSnapshot.ExportJSON
+type jsonDump struct {
+	Nodes  []*models.Node       `json:"nodes"`
+	Jobs   []*models.Job        `json:"jobs"`
+	Orders []*models.Order      `json:"orders"`
+	Evals  []*models.Evaluation `json:"evals"`
+	Allocs []*models.Allocation `json:"allocs"`
+
+	AllocStats []*models.AllocStats `json:"alloc_stats"`
+}
+
+// ImportJSON reads a dump written by StateSnapshot.ExportJSON and upserts
+// its objects at the given index. Unlike the restore path, objects go
+// through the regular upsert methods so that job statuses are recomputed.
+// The index table of the dump is ignored.
+func (s *StateStore) ImportJSON(index uint64, r io.Reader) error {
+	var dump jsonDump
+	if err := json.NewDecoder(r).Decode(&dump); err != nil {
+		return fmt.Errorf("json decode failed: %v", err)
+	}
+
+	for _, node := range dump.Nodes {
+		if err := s.UpsertNode(index, node); err != nil {
+			return err
+		}
+	}
+	// Orders go before jobs so that jobs can claim them
+	for _, order := range dump.Orders {
+		if err := s.UpsertOrder(index, order); err != nil {
+			return err
+		}
+	}
+	for _, job := range dump.Jobs {
+		if err := s.UpsertJob(index, job); err != nil {
+			return err
+		}
+	}
+	if len(dump.Evals) != 0 {
+		if err := s.UpsertEvals(index, dump.Evals); err != nil {
+			return err
+		}
+	}
+	if len(dump.Allocs) != 0 {
+		if err := s.UpsertAllocs(index, dump.Allocs); err != nil {
+			return err
+		}
+	}
+	// Stats go last as they require their allocation to exist
+	for _, stats := range dump.AllocStats {
+		if err := s.UpsertAllocStats(index, stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // AbandonCh returns a channel you can wait on to know if the state store was
 // abandoned.
 func (s *StateStore) AbandonCh() <-chan struct{} {
@@ -120,6 +348,7 @@ func (s *StateStore) UpsertNode(index uint64, node *models.Node) error {
 	if err := txn.Insert("nodes", node); err != nil {
 		return fmt.Errorf("node insert failed: %v", err)
 	}
+	s.audit(txn, "UpsertNode", "nodes", node.ID, index)
 	if err := txn.Insert("index", &IndexEntry{"nodes", index}); err != nil {
 		return fmt.Errorf("index update failed: %v", err)
 	}
@@ -146,6 +375,7 @@ func (s *StateStore) DeleteNode(index uint64, nodeID string) error {
 	if err := txn.Delete("nodes", existing); err != nil {
 		return fmt.Errorf("node delete failed: %v", err)
 	}
+	s.audit(txn, "DeleteNode", "nodes", nodeID, index)
 	if err := txn.Insert("index", &IndexEntry{"nodes", index}); err != nil {
 		return fmt.Errorf("index update failed: %v", err)
 	}
@@ -154,6 +384,79 @@ func (s *StateStore) DeleteNode(index uint64, nodeID string) error {
 	return nil
 }
 
+// DeleteNodeCascade deregisters a node together with its allocations, so
+// that permanently removed nodes don't leave orphaned allocations behind.
+// If removeAllocs is set the allocations are deleted, otherwise the live
+// ones are marked lost and kept. The status of the affected jobs is updated
+// in the same transaction.
+func (s *StateStore) DeleteNodeCascade(index uint64, nodeID string, removeAllocs bool) error {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	existing, err := txn.First("nodes", "id", nodeID)
+	if err != nil {
+		return fmt.Errorf("node lookup failed: %v", err)
+	}
+	if existing == nil {
+		return fmt.Errorf("node not found")
+	}
+	if err := txn.Delete("nodes", existing); err != nil {
+		return fmt.Errorf("node delete failed: %v", err)
+	}
+	s.audit(txn, "DeleteNodeCascade", "nodes", nodeID, index)
+	if err := upsertIndex(txn, "nodes", index); err != nil {
+		return err
+	}
+
+	// Using only the node prefix matches terminal allocs too
+	iter, err := txn.Get("allocs", "node_prefix", nodeID)
+	if err != nil {
+		return fmt.Errorf("alloc lookup failed: %v", err)
+	}
+	var allocs []*models.Allocation
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		alloc := raw.(*models.Allocation)
+
+		// Filter non-exact matches
+		if alloc.NodeID != nodeID {
+			continue
+		}
+		allocs = append(allocs, alloc)
+	}
+
+	jobs := make(map[string]string)
+	for _, alloc := range allocs {
+		if removeAllocs {
+			if err := txn.Delete("allocs", alloc); err != nil {
+				return fmt.Errorf("alloc delete failed: %v", err)
+			}
+			s.audit(txn, "DeleteNodeCascade", "allocs", alloc.ID, index)
+			if err := s.deleteAllocStats(txn, index, alloc.ID); err != nil {
+				return err
+			}
+		} else if !alloc.Terminated() {
+			if err := s.nestedMarkAllocLost(txn, index, "DeleteNodeCascade", alloc); err != nil {
+				return err
+			}
+		} else {
+			continue
+		}
+		jobs[alloc.JobID] = ""
+	}
+
+	if len(jobs) != 0 {
+		if err := upsertIndex(txn, "allocs", index); err != nil {
+			return err
+		}
+		if err := s.setJobStatuses(index, txn, jobs, false); err != nil {
+			return fmt.Errorf("setting job status failed: %v", err)
+		}
+	}
+
+	txn.Commit()
+	return nil
+}
+
 func (s *StateStore) UpdateJobStatus(index uint64, jobID, status string) error {
 	txn := s.db.Txn(true)
 	defer txn.Abort()
@@ -173,8 +476,10 @@ func (s *StateStore) UpdateJobStatus(index uint64, jobID, status string) error {
 	copyJob := new(models.Job)
 	*copyJob = *existingJob
 
-	// Update the status in the copy
+	// Update the status in the copy. An explicit status change takes over
+	// from a maintenance pause.
 	copyJob.Status = status
+	copyJob.MaintenancePaused = false
 	copyJob.ModifyIndex = index
 	copyJob.JobModifyIndex = index
 
@@ -182,6 +487,7 @@ func (s *StateStore) UpdateJobStatus(index uint64, jobID, status string) error {
 	if err := txn.Insert("jobs", copyJob); err != nil {
 		return fmt.Errorf("job insert failed: %v", err)
 	}
+	s.audit(txn, "UpdateJobStatus", "jobs", jobID, index)
 	if err := txn.Insert("index", &IndexEntry{"jobs", index}); err != nil {
 		return fmt.Errorf("index update failed: %v", err)
 	}
@@ -190,8 +496,10 @@ func (s *StateStore) UpdateJobStatus(index uint64, jobID, status string) error {
 	return nil
 }
 
-// UpdateNodeStatus is used to update the status of a node
-func (s *StateStore) UpdateNodeStatus(index uint64, nodeID, status string) error {
+// UpdateNodeStatus is used to update the status of a node. A non-zero
+// updatedAt is recorded as the node's StatusUpdatedAt; zero keeps the
+// previous value, as for requests logged before the field existed.
+func (s *StateStore) UpdateNodeStatus(index uint64, nodeID, status string, updatedAt int64) error {
 	txn := s.db.Txn(true)
 	defer txn.Abort()
 
@@ -211,12 +519,111 @@ func (s *StateStore) UpdateNodeStatus(index uint64, nodeID, status string) error
 
 	// Update the status in the copy
 	copyNode.Status = status
+	if updatedAt != 0 {
+		copyNode.StatusUpdatedAt = updatedAt
+	}
 	copyNode.ModifyIndex = index
 
 	// Insert the node
 	if err := txn.Insert("nodes", copyNode); err != nil {
 		return fmt.Errorf("node update failed: %v", err)
 	}
+	s.audit(txn, "UpdateNodeStatus", "nodes", nodeID, index)
+	if err := txn.Insert("index", &IndexEntry{"nodes", index}); err != nil {
+		return fmt.Errorf("index update failed: %v", err)
+	}
+
+	txn.Commit()
+	return nil
+}
+
+// NodesNotFoundError is returned by UpdateNodesStatus when some of the
+// requested nodes don't exist. Updates to the remaining nodes still apply.
+type NodesNotFoundError struct {
+	NodeIDs []string
+}
+
+func (e *NodesNotFoundError) Error() string {
+	return fmt.Sprintf("%d node(s) not found: %v", len(e.NodeIDs), e.NodeIDs)
+}
+
+// UpdateNodesStatus is used to update the status of many nodes in a single
+// transaction, such as when a whole rack goes offline. Missing nodes are
+// skipped and reported through a *NodesNotFoundError once the nodes that
+// exist have been updated. updatedAt is stamped as in UpdateNodeStatus.
+func (s *StateStore) UpdateNodesStatus(index uint64, nodeIDs []string, status string, updatedAt int64) error {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	var missing []string
+	updated := 0
+	for _, nodeID := range nodeIDs {
+		existing, err := txn.First("nodes", "id", nodeID)
+		if err != nil {
+			return fmt.Errorf("node lookup failed: %v", err)
+		}
+		if existing == nil {
+			missing = append(missing, nodeID)
+			continue
+		}
+
+		// Copy the existing node and update the status in the copy
+		copyNode := new(models.Node)
+		*copyNode = *existing.(*models.Node)
+		copyNode.Status = status
+		if updatedAt != 0 {
+			copyNode.StatusUpdatedAt = updatedAt
+		}
+		copyNode.ModifyIndex = index
+
+		if err := txn.Insert("nodes", copyNode); err != nil {
+			return fmt.Errorf("node update failed: %v", err)
+		}
+		s.audit(txn, "UpdateNodesStatus", "nodes", nodeID, index)
+		updated++
+	}
+
+	if updated != 0 {
+		if err := upsertIndex(txn, "nodes", index); err != nil {
+			return err
+		}
+	}
+
+	txn.Commit()
+	if len(missing) != 0 {
+		return &NodesNotFoundError{NodeIDs: missing}
+	}
+	return nil
+}
+
+// UpdateNodeHeartbeat records a heartbeat for a node by advancing only its
+// StatusUpdatedAt and modify index. The stored node is never modified in
+// place: a shallow copy is inserted instead, which shares the unchanged
+// attributes with the previous version rather than deep copying them.
+// The FSM applies it for heartbeats that don't change the node's status,
+// which the node endpoint only sends once the stored timestamp gets stale.
+func (s *StateStore) UpdateNodeHeartbeat(index uint64, nodeID string, ts time.Time) error {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	// Lookup the node
+	existing, err := txn.First("nodes", "id", nodeID)
+	if err != nil {
+		return fmt.Errorf("node lookup failed: %v", err)
+	}
+	if existing == nil {
+		return fmt.Errorf("node not found")
+	}
+
+	copyNode := new(models.Node)
+	*copyNode = *existing.(*models.Node)
+	copyNode.StatusUpdatedAt = ts.Unix()
+	copyNode.ModifyIndex = index
+
+	if err := txn.Insert("nodes", copyNode); err != nil {
+		return fmt.Errorf("node update failed: %v", err)
+	}
+	s.audit(txn, "UpdateNodeHeartbeat", "nodes", nodeID, index)
 	if err := txn.Insert("index", &IndexEntry{"nodes", index}); err != nil {
 		return fmt.Errorf("index update failed: %v", err)
 	}
@@ -225,6 +632,34 @@ func (s *StateStore) UpdateNodeStatus(index uint64, nodeID, status string) error
 	return nil
 }
 
+// NodesFailingHeartbeat returns the ready nodes whose status was last
+// updated more than ttl before now. StatusUpdatedAt is stamped on
+// registration and on every status change. Heartbeats that keep the status
+// only refresh it through UpdateNodeHeartbeat once it is a few minutes old,
+// so ttl must be well above that interval to avoid false positives.
+func (s *StateStore) NodesFailingHeartbeat(ws memdb.WatchSet, ttl time.Duration, now time.Time) ([]*models.Node, error) {
+	txn := s.db.Txn(false)
+
+	iter, err := txn.Get("nodes", "id")
+	if err != nil {
+		return nil, fmt.Errorf("node lookup failed: %v", err)
+	}
+	ws.Add(iter.WatchCh())
+
+	deadline := now.Add(-ttl)
+	var out []*models.Node
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		node := raw.(*models.Node)
+		if !node.Ready() {
+			continue
+		}
+		if time.Unix(node.StatusUpdatedAt, 0).Before(deadline) {
+			out = append(out, node)
+		}
+	}
+	return out, nil
+}
+
 // NodeByID is used to lookup a node by ID
 func (s *StateStore) NodeByID(ws memdb.WatchSet, nodeID string) (*models.Node, error) {
 	txn := s.db.Txn(false)
@@ -236,6 +671,9 @@ func (s *StateStore) NodeByID(ws memdb.WatchSet, nodeID string) (*models.Node, e
 	ws.Add(watchCh)
 
 	if existing != nil {
+		if s.CopyOnRead {
+			return existing.(*models.Node).Copy(), nil
+		}
 		return existing.(*models.Node), nil
 	}
 	return nil, nil
@@ -353,43 +791,130 @@ func (s *StateStore) Nodes(ws memdb.WatchSet) (memdb.ResultIterator, error) {
 	return iter, nil
 }
 
-// UpsertJob is used to register a job or update a job definition
-func (s *StateStore) UpsertJob(index uint64, job *models.Job) error {
-	txn := s.db.Txn(true)
-	defer txn.Abort()
+// NodesByClass is used to lookup the nodes of a given node class
+func (s *StateStore) NodesByClass(ws memdb.WatchSet, class string) (memdb.ResultIterator, error) {
+	txn := s.db.Txn(false)
 
-	// Check if the job already exists
-	existing, err := txn.First("jobs", "id", job.ID)
+	iter, err := txn.Get("nodes", "class", class)
 	if err != nil {
-		return fmt.Errorf("job lookup failed: %v", err)
+		return nil, err
 	}
 
-	// Setup the indexes correctly
-	if existing != nil {
-		if existing.(*models.Job).Status == models.JobStatusRunning {
-			return nil
-		}
-		job.CreateIndex = existing.(*models.Job).CreateIndex
-		job.ModifyIndex = index
-		job.JobModifyIndex = index
-		for _, t1 := range existing.(*models.Job).Tasks {
-			for i, t2 := range job.Tasks {
-				if t1.Type == t2.Type && t2.Config["NatsAddr"] == nil {
-					t2.Config["NatsAddr"] = t1.Config["NatsAddr"]
-					job.Tasks[i] = t2
-				}
-			}
+	ws.Add(iter.WatchCh())
+
+	return iter, nil
+}
+
+// IdleNodes returns the ready nodes that have no non-terminal allocations,
+// making them candidates for scale-in.
+func (s *StateStore) IdleNodes(ws memdb.WatchSet) ([]*models.Node, error) {
+	txn := s.db.Txn(false)
+
+	iter, err := txn.Get("nodes", "id")
+	if err != nil {
+		return nil, fmt.Errorf("node lookup failed: %v", err)
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Node
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		node := raw.(*models.Node)
+		if node.Status != models.NodeStatusReady {
+			continue
 		}
 
-		// Compute the job status
-		var err error
-		job.Status, err = s.getJobStatus(txn, job, false)
+		// The node index is keyed on whether the alloc is terminal
+		watchCh, alloc, err := txn.FirstWatch("allocs", "node", node.ID, false)
 		if err != nil {
-			return fmt.Errorf("setting job status for %q failed: %v", job.ID, err)
+			return nil, fmt.Errorf("alloc lookup failed: %v", err)
 		}
-	} else {
-		job.CreateIndex = index
-		job.ModifyIndex = index
+		ws.Add(watchCh)
+		if alloc == nil {
+			out = append(out, node)
+		}
+	}
+	return out, nil
+}
+
+// UpsertJob is used to register a job or update a job definition
+func (s *StateStore) UpsertJob(index uint64, job *models.Job) error {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	if err := s.nestedUpsertJob(txn, index, job); err != nil {
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+// RegisterJob is used to upsert a job together with its bootstrap
+// evaluation in a single transaction, so the job never exists without it.
+// If either upsert fails neither is applied.
+func (s *StateStore) RegisterJob(index uint64, job *models.Job, eval *models.Evaluation) error {
+	if eval.JobID != job.ID {
+		return fmt.Errorf("eval %q is for job %q, not %q", eval.ID, eval.JobID, job.ID)
+	}
+
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	if err := s.nestedUpsertJob(txn, index, job); err != nil {
+		return err
+	}
+	if err := s.nestedUpsertEval(txn, index, eval); err != nil {
+		return err
+	}
+	if err := upsertIndex(txn, "evals", index); err != nil {
+		return err
+	}
+
+	// Set the job's status
+	jobs := map[string]string{job.ID: ""}
+	if err := s.setJobStatuses(index, txn, jobs, false); err != nil {
+		return fmt.Errorf("setting job status failed: %v", err)
+	}
+
+	txn.Commit()
+	return nil
+}
+
+// nestedUpsertJob is used to nest a job upsert within a transaction
+func (s *StateStore) nestedUpsertJob(txn *memdb.Txn, index uint64, job *models.Job) error {
+	// Check if the job already exists
+	existing, err := txn.First("jobs", "id", job.ID)
+	if err != nil {
+		return fmt.Errorf("job lookup failed: %v", err)
+	}
+
+	// Setup the indexes correctly
+	if existing != nil {
+		if existing.(*models.Job).Status == models.JobStatusRunning {
+			return nil
+		}
+		job.CreateIndex = existing.(*models.Job).CreateIndex
+		job.ModifyIndex = index
+		job.JobModifyIndex = index
+		for _, t1 := range existing.(*models.Job).Tasks {
+			for i, t2 := range job.Tasks {
+				if t1.Type == t2.Type && t2.Config["NatsAddr"] == nil {
+					t2.Config["NatsAddr"] = t1.Config["NatsAddr"]
+					job.Tasks[i] = t2
+				}
+			}
+		}
+
+		// Compute the job status
+		var err error
+		job.Status, err = s.getJobStatus(txn, job, false)
+		if err != nil {
+			return fmt.Errorf("setting job status for %q failed: %v", job.ID, err)
+		}
+	} else {
+		job.CreateIndex = index
+		job.ModifyIndex = index
 		job.JobModifyIndex = index
 
 		if err := s.setJobStatus(index, txn, job, false, ""); err != nil {
@@ -418,6 +943,7 @@ func (s *StateStore) UpsertJob(index uint64, job *models.Job) error {
 			if err := txn.Insert("orders", o); err != nil {
 				return fmt.Errorf("order insert failed: %v", err)
 			}
+			s.audit(txn, "UpsertJob", "orders", o.ID, index)
 			if err := txn.Insert("index", &IndexEntry{"orders", index}); err != nil {
 				return fmt.Errorf("index update failed: %v", err)
 			}
@@ -431,8 +957,7 @@ func (s *StateStore) UpsertJob(index uint64, job *models.Job) error {
 	if err := txn.Insert("index", &IndexEntry{"jobs", index}); err != nil {
 		return fmt.Errorf("index update failed: %v", err)
 	}
-
-	txn.Commit()
+	s.audit(txn, "UpsertJob", "jobs", job.ID, index)
 	return nil
 }
 
@@ -462,6 +987,7 @@ func (s *StateStore) RenewalJob(index uint64, jobId, orderId string) error {
 		if err := txn.Insert("orders", o); err != nil {
 			return fmt.Errorf("order insert failed: %v", err)
 		}
+		s.audit(txn, "RenewalJob", "orders", o.ID, index)
 		if err := txn.Insert("index", &IndexEntry{"orders", index}); err != nil {
 			return fmt.Errorf("index update failed: %v", err)
 		}
@@ -481,6 +1007,7 @@ func (s *StateStore) RenewalJob(index uint64, jobId, orderId string) error {
 	if err := txn.Insert("jobs", existing.(*models.Job)); err != nil {
 		return fmt.Errorf("job insert failed: %v", err)
 	}
+	s.audit(txn, "RenewalJob", "jobs", jobId, index)
 	if err := txn.Insert("index", &IndexEntry{"jobs", index}); err != nil {
 		return fmt.Errorf("index update failed: %v", err)
 	}
@@ -514,6 +1041,7 @@ func (s *StateStore) DeleteJob(index uint64, jobID string) error {
 		if err := txn.Delete("evals", existing); err != nil {
 			return fmt.Errorf("eval delete failed: %v", err)
 		}
+		s.audit(txn, "DeleteJob", "evals", raw.(*models.Evaluation).ID, index)
 	}
 
 	alloc, err := txn.Get("allocs", "job", jobID)
@@ -536,6 +1064,10 @@ func (s *StateStore) DeleteJob(index uint64, jobID string) error {
 		if err := txn.Delete("allocs", existing); err != nil {
 			return fmt.Errorf("alloc delete failed: %v", err)
 		}
+		s.audit(txn, "DeleteJob", "allocs", raw.(*models.Allocation).ID, index)
+		if err := s.deleteAllocStats(txn, index, raw.(*models.Allocation).ID); err != nil {
+			return err
+		}
 	}
 
 	// Update the indexes
@@ -558,6 +1090,25 @@ func (s *StateStore) DeleteJob(index uint64, jobID string) error {
 	// Delete the job
 	job := existing.(*models.Job)
 
+	if err := s.releaseJobOrders(txn, index, job); err != nil {
+		return err
+	}
+
+	if err := txn.Delete("jobs", job); err != nil {
+		return fmt.Errorf("job delete failed: %v", err)
+	}
+	s.audit(txn, "DeleteJob", "jobs", jobID, index)
+	if err := txn.Insert("index", &IndexEntry{"jobs", index}); err != nil {
+		return fmt.Errorf("index update failed: %v", err)
+	}
+
+	txn.Commit()
+	return nil
+}
+
+// releaseJobOrders is used when a job is removed. Orders that are done are
+// deleted along with the job while the rest go back to pending.
+func (s *StateStore) releaseJobOrders(txn *memdb.Txn, index uint64, job *models.Job) error {
 	for _, orderId := range job.Orders {
 		order, err := txn.First("orders", "id", orderId)
 		if err != nil {
@@ -569,6 +1120,7 @@ func (s *StateStore) DeleteJob(index uint64, jobID string) error {
 				if err := txn.Delete("orders", o); err != nil {
 					return fmt.Errorf("order delete failed: %v", err)
 				}
+				s.audit(txn, "ReleaseJobOrders", "orders", o.ID, index)
 				if err := txn.Insert("index", &IndexEntry{"orders", index}); err != nil {
 					return fmt.Errorf("index update failed: %v", err)
 				}
@@ -578,332 +1130,524 @@ func (s *StateStore) DeleteJob(index uint64, jobID string) error {
 				if err := txn.Insert("orders", o); err != nil {
 					return fmt.Errorf("order insert failed: %v", err)
 				}
+				s.audit(txn, "ReleaseJobOrders", "orders", o.ID, index)
 				if err := txn.Insert("index", &IndexEntry{"orders", index}); err != nil {
 					return fmt.Errorf("index update failed: %v", err)
 				}
 			}
 		}
 	}
-
-	if err := txn.Delete("jobs", job); err != nil {
-		return fmt.Errorf("job delete failed: %v", err)
-	}
-	if err := txn.Insert("index", &IndexEntry{"jobs", index}); err != nil {
-		return fmt.Errorf("index update failed: %v", err)
-	}
-
-	txn.Commit()
 	return nil
 }
 
-// JobByID is used to lookup a job by its ID
-func (s *StateStore) JobByID(ws memdb.WatchSet, id string) (*models.Job, error) {
-	txn := s.db.Txn(false)
+// GCStats counts the objects removed by GarbageCollect
+type GCStats struct {
+	// Jobs, Evals and Allocs count dead jobs and the evaluations and
+	// allocations that were removed along with them.
+	Jobs   int
+	Evals  int
+	Allocs int
 
-	watchCh, existing, err := txn.FirstWatch("jobs", "id", id)
-	if err != nil {
-		return nil, fmt.Errorf("job lookup failed: %v", err)
-	}
-	ws.Add(watchCh)
+	// OrphanedAllocs counts allocations whose job no longer exists
+	OrphanedAllocs int
 
-	if existing != nil {
-		return existing.(*models.Job), nil
-	}
-	return nil, nil
+	// ReplacedAllocs counts failed allocations whose replacement is running
+	ReplacedAllocs int
 }
 
-// JobsByIDPrefix is used to lookup a job by prefix
-func (s *StateStore) JobsByIDPrefix(ws memdb.WatchSet, id string) (memdb.ResultIterator, error) {
-	txn := s.db.Txn(false)
+// GarbageCollect removes, in a single transaction, every dead or complete
+// job last modified at or before threshold together with its evaluations
+// and allocations, as well as allocations at or before threshold whose job
+// is gone. A job is only collected once all of its evals and allocs are
+// terminal. Failed allocations are collected regardless of threshold once
+// the allocation replacing them is running. Allocations carry no
+// NextAllocation link, so replacements are found by walking the
+// PreviousAllocation of running allocations instead.
+func (s *StateStore) GarbageCollect(index uint64, threshold uint64) (*GCStats, error) {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
 
-	iter, err := txn.Get("jobs", "id_prefix", id)
-	if err != nil {
-		return nil, fmt.Errorf("job lookup failed: %v", err)
+	var candidates []*models.Job
+	if err := IterateTable(txn, "jobs", "id", func(job *models.Job) error {
+		if job.ModifyIndex > threshold {
+			return nil
+		}
+		if job.Status == models.JobStatusDead || job.Status == models.JobStatusComplete {
+			candidates = append(candidates, job)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 
-	ws.Add(iter.WatchCh())
+	stats := &GCStats{}
+	for _, job := range candidates {
+		evals, err := txn.Get("evals", "job_prefix", job.ID)
+		if err != nil {
+			return nil, fmt.Errorf("eval lookup failed: %v", err)
+		}
+		var jobEvals []*models.Evaluation
+		live := false
+		for raw := evals.Next(); raw != nil; raw = evals.Next() {
+			e := raw.(*models.Evaluation)
+
+			// Filter non-exact matches
+			if e.JobID != job.ID {
+				continue
+			}
+			if !e.TerminalStatus() {
+				live = true
+				break
+			}
+			jobEvals = append(jobEvals, e)
+		}
+		if live {
+			continue
+		}
 
-	return iter, nil
-}
+		allocs, err := txn.Get("allocs", "job", job.ID)
+		if err != nil {
+			return nil, fmt.Errorf("alloc lookup failed: %v", err)
+		}
+		var jobAllocs []*models.Allocation
+		for raw := allocs.Next(); raw != nil; raw = allocs.Next() {
+			alloc := raw.(*models.Allocation)
+			if !alloc.TerminalStatus() {
+				live = true
+				break
+			}
+			jobAllocs = append(jobAllocs, alloc)
+		}
+		if live {
+			continue
+		}
 
-// Jobs returns an iterator over all the jobs
-func (s *StateStore) Jobs(ws memdb.WatchSet) (memdb.ResultIterator, error) {
-	txn := s.db.Txn(false)
+		for _, eval := range jobEvals {
+			if err := txn.Delete("evals", eval); err != nil {
+				return nil, fmt.Errorf("eval delete failed: %v", err)
+			}
+			s.audit(txn, "GarbageCollect", "evals", eval.ID, index)
+		}
+		for _, alloc := range jobAllocs {
+			if err := txn.Delete("allocs", alloc); err != nil {
+				return nil, fmt.Errorf("alloc delete failed: %v", err)
+			}
+			s.audit(txn, "GarbageCollect", "allocs", alloc.ID, index)
+			if err := s.deleteAllocStats(txn, index, alloc.ID); err != nil {
+				return nil, err
+			}
+		}
+		if err := s.releaseJobOrders(txn, index, job); err != nil {
+			return nil, err
+		}
+		if err := txn.Delete("jobs", job); err != nil {
+			return nil, fmt.Errorf("job delete failed: %v", err)
+		}
+		s.audit(txn, "GarbageCollect", "jobs", job.ID, index)
 
-	// Walk the entire jobs table
-	iter, err := txn.Get("jobs", "id")
-	if err != nil {
-		return nil, err
+		stats.Jobs++
+		stats.Evals += len(jobEvals)
+		stats.Allocs += len(jobAllocs)
 	}
 
-	ws.Add(iter.WatchCh())
-
-	return iter, nil
-}
-
-// JobsByScheduler returns an iterator over all the jobs with the specific
-// scheduler type.
-func (s *StateStore) JobsByScheduler(ws memdb.WatchSet, schedulerType string) (memdb.ResultIterator, error) {
-	txn := s.db.Txn(false)
-
-	// Return an iterator for jobs with the specific type.
-	iter, err := txn.Get("jobs", "type", schedulerType)
-	if err != nil {
+	var orphans []*models.Allocation
+	if err := IterateTable(txn, "allocs", "id", func(alloc *models.Allocation) error {
+		if alloc.ModifyIndex > threshold {
+			return nil
+		}
+		job, err := txn.First("jobs", "id", alloc.JobID)
+		if err != nil {
+			return fmt.Errorf("job lookup failed: %v", err)
+		}
+		if job == nil {
+			orphans = append(orphans, alloc)
+		}
+		return nil
+	}); err != nil {
 		return nil, err
 	}
+	removed := make(map[string]*models.Allocation, len(orphans))
+	for _, alloc := range orphans {
+		removed[alloc.ID] = alloc
+		if err := txn.Delete("allocs", alloc); err != nil {
+			return nil, fmt.Errorf("alloc delete failed: %v", err)
+		}
+		s.audit(txn, "GarbageCollect", "allocs", alloc.ID, index)
+		if err := s.deleteAllocStats(txn, index, alloc.ID); err != nil {
+			return nil, err
+		}
+	}
+	stats.OrphanedAllocs = len(orphans)
 
-	ws.Add(iter.WatchCh())
-
-	return iter, nil
-}
+	// The scheduler links a replacement to the alloc it replaces through
+	// PreviousAllocation, so walk the running allocs back to failed ones.
+	running, err := txn.Get("allocs", "client_status", models.AllocClientStatusRunning)
+	if err != nil {
+		return nil, fmt.Errorf("alloc lookup failed: %v", err)
+	}
+	var replaced []*models.Allocation
+	for raw := running.Next(); raw != nil; raw = running.Next() {
+		alloc := raw.(*models.Allocation)
+		if alloc.PreviousAllocation == "" {
+			continue
+		}
 
-//order start
-func (s *StateStore) UpsertOrder(index uint64, order *models.Order) error {
-	txn := s.db.Txn(true)
-	defer txn.Abort()
+		// Several allocs may replace the same one, and orphans are gone
+		// already; either way it must only be deleted once.
+		if _, ok := removed[alloc.PreviousAllocation]; ok {
+			continue
+		}
+		prev, err := txn.First("allocs", "id", alloc.PreviousAllocation)
+		if err != nil {
+			return nil, fmt.Errorf("alloc lookup failed: %v", err)
+		}
+		if prev != nil && prev.(*models.Allocation).ClientStatus == models.AllocClientStatusFailed {
+			replaced = append(replaced, prev.(*models.Allocation))
+			removed[alloc.PreviousAllocation] = prev.(*models.Allocation)
+		}
+	}
+	for _, alloc := range replaced {
+		if err := txn.Delete("allocs", alloc); err != nil {
+			return nil, fmt.Errorf("alloc delete failed: %v", err)
+		}
+		s.audit(txn, "GarbageCollect", "allocs", alloc.ID, index)
+		if err := s.deleteAllocStats(txn, index, alloc.ID); err != nil {
+			return nil, err
+		}
+	}
+	stats.ReplacedAllocs = len(replaced)
 
-	// Insert the job
-	if err := txn.Insert("orders", order); err != nil {
-		return fmt.Errorf("order insert failed: %v", err)
+	// Update the indexes
+	if stats.Jobs != 0 {
+		if err := txn.Insert("index", &IndexEntry{"jobs", index}); err != nil {
+			return nil, fmt.Errorf("index update failed: %v", err)
+		}
 	}
-	if err := txn.Insert("index", &IndexEntry{"orders", index}); err != nil {
-		return fmt.Errorf("index update failed: %v", err)
+	if stats.Evals != 0 {
+		if err := txn.Insert("index", &IndexEntry{"evals", index}); err != nil {
+			return nil, fmt.Errorf("index update failed: %v", err)
+		}
+	}
+	if stats.Allocs+stats.OrphanedAllocs+stats.ReplacedAllocs != 0 {
+		if err := txn.Insert("index", &IndexEntry{"allocs", index}); err != nil {
+			return nil, fmt.Errorf("index update failed: %v", err)
+		}
 	}
 
 	txn.Commit()
-	return nil
+	return stats, nil
 }
 
-// DeleteJob is used to deregister a job
-func (s *StateStore) DeleteOrder(index uint64, orderID string) error {
+// RenameJob re-keys a job and everything that references it (evaluations,
+// allocations and orders) from oldID to newID in a single transaction. It
+// errors if the job doesn't exist or newID is already taken.
+func (s *StateStore) RenameJob(index uint64, oldID, newID string) error {
+	if oldID == newID {
+		return fmt.Errorf("job %q can not be renamed to itself", oldID)
+	}
+
 	txn := s.db.Txn(true)
 	defer txn.Abort()
 
-	// Lookup the node
-	existing, err := txn.First("orders", "id", orderID)
+	existing, err := txn.First("jobs", "id", oldID)
 	if err != nil {
-		return fmt.Errorf("order lookup failed: %v", err)
+		return fmt.Errorf("job lookup failed: %v", err)
 	}
 	if existing == nil {
-		return fmt.Errorf("order not found")
+		return fmt.Errorf("job not found")
 	}
-
-	// Delete the order
-	order := existing.(*models.Order)
-
-	if err := txn.Delete("orders", order); err != nil {
-		return fmt.Errorf("order delete failed: %v", err)
+	taken, err := txn.First("jobs", "id", newID)
+	if err != nil {
+		return fmt.Errorf("job lookup failed: %v", err)
 	}
-	if err := txn.Insert("index", &IndexEntry{"orders", index}); err != nil {
-		return fmt.Errorf("index update failed: %v", err)
+	if taken != nil {
+		return fmt.Errorf("job %q already exists", newID)
 	}
 
-	txn.Commit()
-	return nil
-}
-
-// JobByID is used to lookup a job by its ID
-func (s *StateStore) OrderByID(ws memdb.WatchSet, id string) (*models.Order, error) {
-	txn := s.db.Txn(false)
+	// Move the job itself
+	oldJob := existing.(*models.Job)
+	newJob := oldJob.Copy()
+	newJob.ID = newID
+	newJob.ModifyIndex = index
+	if err := txn.Delete("jobs", oldJob); err != nil {
+		return fmt.Errorf("job delete failed: %v", err)
+	}
+	if err := txn.Insert("jobs", newJob); err != nil {
+		return fmt.Errorf("job insert failed: %v", err)
+	}
+	s.audit(txn, "RenameJob", "jobs", newID, index)
 
-	watchCh, existing, err := txn.FirstWatch("orders", "id", id)
+	// Move the evaluations. Collect first since we update the job index
+	// we are iterating over.
+	evalIter, err := txn.Get("evals", "job_prefix", oldID)
 	if err != nil {
-		return nil, fmt.Errorf("Order lookup failed: %v", err)
+		return fmt.Errorf("eval lookup failed: %v", err)
 	}
-	ws.Add(watchCh)
-
-	if existing != nil {
-		return existing.(*models.Order), nil
+	var evals []*models.Evaluation
+	for raw := evalIter.Next(); raw != nil; raw = evalIter.Next() {
+		if eval := raw.(*models.Evaluation); eval.JobID == oldID {
+			evals = append(evals, eval)
+		}
+	}
+	for _, eval := range evals {
+		newEval := eval.Copy()
+		newEval.JobID = newID
+		newEval.ModifyIndex = index
+		if err := txn.Insert("evals", newEval); err != nil {
+			return fmt.Errorf("eval insert failed: %v", err)
+		}
+		s.audit(txn, "RenameJob", "evals", newEval.ID, index)
 	}
-	return nil, nil
-}
 
-// JobsByIDPrefix is used to lookup a job by prefix
-func (s *StateStore) OrdersByIDPrefix(ws memdb.WatchSet, id string) (memdb.ResultIterator, error) {
-	txn := s.db.Txn(false)
-
-	iter, err := txn.Get("orders", "id_prefix", id)
+	// Move the allocations
+	allocIter, err := txn.Get("allocs", "job", oldID)
 	if err != nil {
-		return nil, fmt.Errorf("job lookup failed: %v", err)
+		return fmt.Errorf("alloc lookup failed: %v", err)
 	}
-
-	ws.Add(iter.WatchCh())
-
-	return iter, nil
-}
-
-// Jobs returns an iterator over all the jobs
-func (s *StateStore) Orders(ws memdb.WatchSet) (memdb.ResultIterator, error) {
-	txn := s.db.Txn(false)
-
-	// Walk the entire jobs table
-	iter, err := txn.Get("orders", "id")
-	if err != nil {
-		return nil, err
+	var allocs []*models.Allocation
+	for raw := allocIter.Next(); raw != nil; raw = allocIter.Next() {
+		allocs = append(allocs, raw.(*models.Allocation))
 	}
-
-	ws.Add(iter.WatchCh())
-
-	return iter, nil
-}
-
-//order end
-
-// UpsertEvals is used to upsert a set of evaluations
-func (s *StateStore) UpsertEvals(index uint64, evals []*models.Evaluation) error {
-	txn := s.db.Txn(true)
-	defer txn.Abort()
-
-	// Do a nested upsert
-	jobs := make(map[string]string, len(evals))
-	for _, eval := range evals {
-		if err := s.nestedUpsertEval(txn, index, eval); err != nil {
-			return err
+	for _, alloc := range allocs {
+		newAlloc := alloc.Copy()
+		newAlloc.JobID = newID
+		if newAlloc.Job != nil {
+			newAlloc.Job.ID = newID
+		}
+		newAlloc.ModifyIndex = index
+		if err := txn.Insert("allocs", newAlloc); err != nil {
+			return fmt.Errorf("alloc insert failed: %v", err)
 		}
+		s.audit(txn, "RenameJob", "allocs", newAlloc.ID, index)
+	}
 
-		jobs[eval.JobID] = ""
+	// Point the job's orders at the new ID
+	for _, orderId := range newJob.Orders {
+		order, err := txn.First("orders", "id", orderId)
+		if err != nil {
+			return fmt.Errorf("order lookup failed: %v", err)
+		}
+		if order == nil || order.(*models.Order).JobID != oldID {
+			continue
+		}
+		o := new(models.Order)
+		*o = *order.(*models.Order)
+		o.JobID = newID
+		if err := txn.Insert("orders", o); err != nil {
+			return fmt.Errorf("order insert failed: %v", err)
+		}
+		s.audit(txn, "RenameJob", "orders", o.ID, index)
+		if err := txn.Insert("index", &IndexEntry{"orders", index}); err != nil {
+			return fmt.Errorf("index update failed: %v", err)
+		}
 	}
 
-	// Set the job's status
-	if err := s.setJobStatuses(index, txn, jobs, false); err != nil {
-		return fmt.Errorf("setting job status failed: %v", err)
+	// Update the indexes
+	if err := txn.Insert("index", &IndexEntry{"jobs", index}); err != nil {
+		return fmt.Errorf("index update failed: %v", err)
+	}
+	if len(evals) != 0 {
+		if err := txn.Insert("index", &IndexEntry{"evals", index}); err != nil {
+			return fmt.Errorf("index update failed: %v", err)
+		}
+	}
+	if len(allocs) != 0 {
+		if err := txn.Insert("index", &IndexEntry{"allocs", index}); err != nil {
+			return fmt.Errorf("index update failed: %v", err)
+		}
 	}
 
 	txn.Commit()
 	return nil
 }
 
-// nestedUpsertEvaluation is used to nest an evaluation upsert within a transaction
-func (s *StateStore) nestedUpsertEval(txn *memdb.Txn, index uint64, eval *models.Evaluation) error {
-	// Lookup the evaluation
-	existing, err := txn.First("evals", "id", eval.ID)
+// PauseAllJobs pauses every job that isn't already paused or terminal, and
+// marks their live allocations to be paused, in a single transaction. It
+// returns the number of jobs paused.
+func (s *StateStore) PauseAllJobs(index uint64) (int, error) {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	iter, err := txn.Get("jobs", "id")
 	if err != nil {
-		return fmt.Errorf("eval lookup failed: %v", err)
+		return 0, fmt.Errorf("job lookup failed: %v", err)
 	}
 
-	// Update the indexes
-	if existing != nil {
-		eval.CreateIndex = existing.(*models.Evaluation).CreateIndex
-		eval.ModifyIndex = index
-	} else {
-		eval.CreateIndex = index
-		eval.ModifyIndex = index
-	}
+	var jobs []*models.Job
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		job := raw.(*models.Job)
+		switch job.Status {
+		case models.JobStatusPause, models.JobStatusDead, models.JobStatusComplete:
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+
+	pausedAllocs := false
+	for _, job := range jobs {
+		updated := job.Copy()
+		updated.Status = models.JobStatusPause
+		updated.StatusDescription = maintenancePauseDesc
+		updated.MaintenancePaused = true
+		updated.ModifyIndex = index
+		updated.JobModifyIndex = index
+		if err := txn.Insert("jobs", updated); err != nil {
+			return 0, fmt.Errorf("job insert failed: %v", err)
+		}
+		s.audit(txn, "PauseAllJobs", "jobs", job.ID, index)
 
-	// Check if the job has any blocked evaluations and cancel them
-	if eval.Status == models.EvalStatusComplete && len(eval.FailedTGAllocs) == 0 {
-		// Get the blocked evaluation for a job if it exists
-		iter, err := txn.Get("evals", "job", eval.JobID, models.EvalStatusBlocked)
+		allocs, err := txn.Get("allocs", "job", job.ID)
 		if err != nil {
-			return fmt.Errorf("failed to get blocked evals for job %q: %v", eval.JobID, err)
+			return 0, fmt.Errorf("alloc lookup failed: %v", err)
 		}
-
-		var blocked []*models.Evaluation
-		for {
-			raw := iter.Next()
-			if raw == nil {
-				break
+		var live []*models.Allocation
+		for raw := allocs.Next(); raw != nil; raw = allocs.Next() {
+			if alloc := raw.(*models.Allocation); !alloc.TerminalStatus() &&
+				alloc.DesiredStatus != models.AllocDesiredStatusPause {
+				live = append(live, alloc)
 			}
-			blocked = append(blocked, raw.(*models.Evaluation))
 		}
-
-		// Go through and update the evals
-		for _, eval := range blocked {
-			newEval := eval.Copy()
-			newEval.Status = models.EvalStatusCancelled
-			newEval.StatusDescription = fmt.Sprintf("evaluation %q successful", newEval.ID)
-			newEval.ModifyIndex = index
-			if err := txn.Insert("evals", newEval); err != nil {
-				return fmt.Errorf("eval insert failed: %v", err)
+		for _, alloc := range live {
+			copyAlloc := alloc.Copy()
+			copyAlloc.DesiredStatus = models.AllocDesiredStatusPause
+			copyAlloc.DesiredDescription = maintenancePauseDesc
+			copyAlloc.MaintenancePaused = true
+			trackDesiredStatus(copyAlloc, alloc)
+			copyAlloc.ModifyIndex = index
+			copyAlloc.AllocModifyIndex = index
+			if err := txn.Insert("allocs", copyAlloc); err != nil {
+				return 0, fmt.Errorf("alloc insert failed: %v", err)
 			}
+			s.audit(txn, "PauseAllJobs", "allocs", alloc.ID, index)
+			pausedAllocs = true
 		}
 	}
 
-	// Insert the eval
-	if err := txn.Insert("evals", eval); err != nil {
-		return fmt.Errorf("eval insert failed: %v", err)
+	// Update the indexes
+	if len(jobs) != 0 {
+		if err := txn.Insert("index", &IndexEntry{"jobs", index}); err != nil {
+			return 0, fmt.Errorf("index update failed: %v", err)
+		}
 	}
-	if err := txn.Insert("index", &IndexEntry{"evals", index}); err != nil {
-		return fmt.Errorf("index update failed: %v", err)
+	if pausedAllocs {
+		if err := txn.Insert("index", &IndexEntry{"allocs", index}); err != nil {
+			return 0, fmt.Errorf("index update failed: %v", err)
+		}
 	}
-	return nil
+
+	txn.Commit()
+	return len(jobs), nil
 }
 
-// DeleteEval is used to delete an evaluation
-func (s *StateStore) DeleteEval(index uint64, evals []string, allocs []string) error {
+// ResumeAllJobs resumes the jobs paused by PauseAllJobs, in a single
+// transaction. They are told apart by the MaintenancePaused flag, so jobs a
+// user paused explicitly, before or since, are left alone. The status of
+// each resumed job is recomputed from its allocations and evaluations rather
+// than assumed to be running. It returns the number of jobs resumed.
+func (s *StateStore) ResumeAllJobs(index uint64) (int, error) {
 	txn := s.db.Txn(true)
 	defer txn.Abort()
 
-	jobs := make(map[string]string, len(evals))
-	for _, eval := range evals {
-		existing, err := txn.First("evals", "id", eval)
+	iter, err := txn.Get("jobs", "id")
+	if err != nil {
+		return 0, fmt.Errorf("job lookup failed: %v", err)
+	}
+
+	var jobs []*models.Job
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		job := raw.(*models.Job)
+		if job.Status == models.JobStatusPause && job.MaintenancePaused {
+			jobs = append(jobs, job)
+		}
+	}
+
+	resumedAllocs := false
+	for _, job := range jobs {
+		// Resume the allocations paused along with the job first, so the
+		// job status is computed from their resumed state
+		allocs, err := txn.Get("allocs", "job", job.ID)
 		if err != nil {
-			return fmt.Errorf("eval lookup failed: %v", err)
+			return 0, fmt.Errorf("alloc lookup failed: %v", err)
 		}
-		if existing == nil {
-			continue
+		var paused []*models.Allocation
+		for raw := allocs.Next(); raw != nil; raw = allocs.Next() {
+			if alloc := raw.(*models.Allocation); alloc.DesiredStatus == models.AllocDesiredStatusPause &&
+				alloc.MaintenancePaused {
+				paused = append(paused, alloc)
+			}
 		}
-		if err := txn.Delete("evals", existing); err != nil {
-			return fmt.Errorf("eval delete failed: %v", err)
+		for _, alloc := range paused {
+			copyAlloc := alloc.Copy()
+			copyAlloc.DesiredStatus = models.AllocDesiredStatusRun
+			copyAlloc.DesiredDescription = ""
+			copyAlloc.MaintenancePaused = false
+			trackDesiredStatus(copyAlloc, alloc)
+			copyAlloc.ModifyIndex = index
+			copyAlloc.AllocModifyIndex = index
+			if err := txn.Insert("allocs", copyAlloc); err != nil {
+				return 0, fmt.Errorf("alloc insert failed: %v", err)
+			}
+			s.audit(txn, "ResumeAllJobs", "allocs", alloc.ID, index)
+			resumedAllocs = true
 		}
-		jobID := existing.(*models.Evaluation).JobID
-		jobs[jobID] = ""
-	}
 
-	for _, alloc := range allocs {
-		existing, err := txn.First("allocs", "id", alloc)
+		updated := job.Copy()
+		updated.StatusDescription = ""
+		updated.MaintenancePaused = false
+		updated.ModifyIndex = index
+		updated.JobModifyIndex = index
+		updated.Status, err = s.getJobStatus(txn, updated, false)
 		if err != nil {
-			return fmt.Errorf("alloc lookup failed: %v", err)
-		}
-		if existing == nil {
-			continue
+			return 0, fmt.Errorf("setting job status for %q failed: %v", job.ID, err)
 		}
-		if err := txn.Delete("allocs", existing); err != nil {
-			return fmt.Errorf("alloc delete failed: %v", err)
+		if err := txn.Insert("jobs", updated); err != nil {
+			return 0, fmt.Errorf("job insert failed: %v", err)
 		}
+		s.audit(txn, "ResumeAllJobs", "jobs", job.ID, index)
 	}
 
 	// Update the indexes
-	if err := txn.Insert("index", &IndexEntry{"evals", index}); err != nil {
-		return fmt.Errorf("index update failed: %v", err)
-	}
-	if err := txn.Insert("index", &IndexEntry{"allocs", index}); err != nil {
-		return fmt.Errorf("index update failed: %v", err)
+	if len(jobs) != 0 {
+		if err := txn.Insert("index", &IndexEntry{"jobs", index}); err != nil {
+			return 0, fmt.Errorf("index update failed: %v", err)
+		}
 	}
-
-	// Set the job's status
-	if err := s.setJobStatuses(index, txn, jobs, true); err != nil {
-		return fmt.Errorf("setting job status failed: %v", err)
+	if resumedAllocs {
+		if err := txn.Insert("index", &IndexEntry{"allocs", index}); err != nil {
+			return 0, fmt.Errorf("index update failed: %v", err)
+		}
 	}
 
 	txn.Commit()
-	return nil
+	return len(jobs), nil
 }
 
-// EvalByID is used to lookup an eval by its ID
-func (s *StateStore) EvalByID(ws memdb.WatchSet, id string) (*models.Evaluation, error) {
+// JobByID is used to lookup a job by its ID
+func (s *StateStore) JobByID(ws memdb.WatchSet, id string) (*models.Job, error) {
 	txn := s.db.Txn(false)
 
-	watchCh, existing, err := txn.FirstWatch("evals", "id", id)
+	watchCh, existing, err := txn.FirstWatch("jobs", "id", id)
 	if err != nil {
-		return nil, fmt.Errorf("eval lookup failed: %v", err)
+		return nil, fmt.Errorf("job lookup failed: %v", err)
 	}
-
 	ws.Add(watchCh)
 
 	if existing != nil {
-		return existing.(*models.Evaluation), nil
+		if s.CopyOnRead {
+			return existing.(*models.Job).Copy(), nil
+		}
+		return existing.(*models.Job), nil
 	}
 	return nil, nil
 }
 
-// EvalsByIDPrefix is used to lookup evaluations by prefix
-func (s *StateStore) EvalsByIDPrefix(ws memdb.WatchSet, id string) (memdb.ResultIterator, error) {
+// JobsByIDPrefix is used to lookup a job by prefix
+func (s *StateStore) JobsByIDPrefix(ws memdb.WatchSet, id string) (memdb.ResultIterator, error) {
 	txn := s.db.Txn(false)
 
-	iter, err := txn.Get("evals", "id_prefix", id)
+	iter, err := txn.Get("jobs", "id_prefix", id)
 	if err != nil {
-		return nil, fmt.Errorf("eval lookup failed: %v", err)
+		return nil, fmt.Errorf("job lookup failed: %v", err)
 	}
 
 	ws.Add(iter.WatchCh())
@@ -911,291 +1655,375 @@ func (s *StateStore) EvalsByIDPrefix(ws memdb.WatchSet, id string) (memdb.Result
 	return iter, nil
 }
 
-// EvalsByJob returns all the evaluations by job id
-func (s *StateStore) EvalsByJob(ws memdb.WatchSet, jobID string) ([]*models.Evaluation, error) {
+// Jobs returns an iterator over all the jobs
+func (s *StateStore) Jobs(ws memdb.WatchSet) (memdb.ResultIterator, error) {
 	txn := s.db.Txn(false)
 
-	// Get an iterator over the node allocations
-	iter, err := txn.Get("evals", "job_prefix", jobID)
+	// Walk the entire jobs table
+	iter, err := txn.Get("jobs", "id")
 	if err != nil {
 		return nil, err
 	}
 
 	ws.Add(iter.WatchCh())
 
-	var out []*models.Evaluation
-	for {
-		raw := iter.Next()
-		if raw == nil {
-			break
-		}
+	return iter, nil
+}
 
-		e := raw.(*models.Evaluation)
+// JobsWithoutAllocs returns the jobs that are not dead or complete but have
+// no allocations under their current create index. Such jobs point at a
+// scheduling problem.
+func (s *StateStore) JobsWithoutAllocs(ws memdb.WatchSet) ([]*models.Job, error) {
+	txn := s.db.Txn(false)
 
-		// Filter non-exact matches
-		if e.JobID != jobID {
+	jobs, err := txn.Get("jobs", "id")
+	if err != nil {
+		return nil, err
+	}
+	ws.Add(jobs.WatchCh())
+
+	var out []*models.Job
+	for raw := jobs.Next(); raw != nil; raw = jobs.Next() {
+		job := raw.(*models.Job)
+		if job.Status == models.JobStatusDead || job.Status == models.JobStatusComplete {
 			continue
 		}
 
-		out = append(out, e)
+		allocs, err := txn.Get("allocs", "job", job.ID)
+		if err != nil {
+			return nil, err
+		}
+		ws.Add(allocs.WatchCh())
+
+		hasAlloc := false
+		for rawAlloc := allocs.Next(); rawAlloc != nil; rawAlloc = allocs.Next() {
+			alloc := rawAlloc.(*models.Allocation)
+			if alloc.Job == nil || alloc.Job.CreateIndex == job.CreateIndex {
+				hasAlloc = true
+				break
+			}
+		}
+		if !hasAlloc {
+			out = append(out, job)
+		}
 	}
 	return out, nil
 }
 
-// Evals returns an iterator over all the evaluations
-func (s *StateStore) Evals(ws memdb.WatchSet) (memdb.ResultIterator, error) {
+// PendingJobsOldestFirst returns the jobs in pending status, those that have
+// been pending the longest first. Jobs are ordered by SubmitTime. Jobs
+// registered before SubmitTime was recorded don't have one; they are older
+// than any job that does, so they come first, ordered by create index.
+func (s *StateStore) PendingJobsOldestFirst(ws memdb.WatchSet) ([]*models.Job, error) {
 	txn := s.db.Txn(false)
 
-	// Walk the entire table
-	iter, err := txn.Get("evals", "id")
+	iter, err := txn.Get("jobs", "id")
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("job lookup failed: %v", err)
 	}
 
 	ws.Add(iter.WatchCh())
 
-	return iter, nil
+	var out []*models.Job
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		job := raw.(*models.Job)
+		if job.Status == models.JobStatusPending {
+			out = append(out, job)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.SubmitTime != b.SubmitTime {
+			return a.SubmitTime < b.SubmitTime
+		}
+		if a.CreateIndex != b.CreateIndex {
+			return a.CreateIndex < b.CreateIndex
+		}
+		return a.ID < b.ID
+	})
+	return out, nil
 }
 
-func (s *StateStore) UpdateJobFromClient(index uint64, job *models.Job) error {
-	txn := s.db.Txn(true)
-	defer txn.Abort()
+// JobsByScheduler returns an iterator over all the jobs with the specific
+// scheduler type.
+func (s *StateStore) JobsByScheduler(ws memdb.WatchSet, schedulerType string) (memdb.ResultIterator, error) {
+	txn := s.db.Txn(false)
 
-	// Insert the job
-	if err := txn.Insert("jobs", job); err != nil {
-		return fmt.Errorf("job insert failed: %v", err)
+	// Return an iterator for jobs with the specific type.
+	iter, err := txn.Get("jobs", "type", schedulerType)
+	if err != nil {
+		return nil, err
 	}
-	if err := txn.Insert("index", &IndexEntry{"jobs", index}); err != nil {
-		return fmt.Errorf("index update failed: %v", err)
+
+	ws.Add(iter.WatchCh())
+
+	return iter, nil
+}
+
+// JobsBySchedulerAndStatus returns the jobs of the given scheduler type
+// that are in the given status. The type index narrows the scan and the
+// status is filtered on read.
+func (s *StateStore) JobsBySchedulerAndStatus(ws memdb.WatchSet, schedulerType, status string) ([]*models.Job, error) {
+	iter, err := s.JobsByScheduler(ws, schedulerType)
+	if err != nil {
+		return nil, fmt.Errorf("job lookup failed: %v", err)
 	}
 
-	txn.Commit()
-	return nil
+	var out []*models.Job
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		job := raw.(*models.Job)
+		if job.Status == status {
+			out = append(out, job)
+		}
+	}
+	return out, nil
 }
 
-// UpdateAllocsFromClient is used to update an allocation based on input
-// from a client. While the schedulers are the authority on the allocation for
-// most things, some updates are authoritative from the client. Specifically,
-// the desired store comes from the schedulers, while the actual store comes
-// from clients.
-func (s *StateStore) UpdateAllocsFromClient(index uint64, allocs []*models.Allocation) error {
-	txn := s.db.Txn(true)
-	defer txn.Abort()
+// JobsByMeta returns the jobs whose metadata maps key to value. It is
+// served by the "meta" index, which holds one entry per key/value pair. An
+// empty value matches every job that sets the key, whatever its value.
+func (s *StateStore) JobsByMeta(ws memdb.WatchSet, key, value string) ([]*models.Job, error) {
+	txn := s.db.Txn(false)
 
-	// Handle each of the updated allocations
-	for _, alloc := range allocs {
-		if err := s.nestedUpdateAllocFromClient(txn, index, alloc); err != nil {
-			return err
-		}
+	// Entries are null terminated, so looking up only the key matches all
+	// of its values but never a longer key.
+	args := []interface{}{key}
+	if value != "" {
+		args = append(args, value)
 	}
-
-	// Update the indexes
-	if err := txn.Insert("index", &IndexEntry{"allocs", index}); err != nil {
-		return fmt.Errorf("index update failed: %v", err)
+	iter, err := txn.Get("jobs", "meta", args...)
+	if err != nil {
+		return nil, fmt.Errorf("job lookup failed: %v", err)
 	}
 
-	txn.Commit()
-	return nil
-}
+	ws.Add(iter.WatchCh())
 
-// nestedUpdateAllocFromClient is used to nest an update of an allocation with client status
-func (s *StateStore) nestedUpdateAllocFromClient(txn *memdb.Txn, index uint64, alloc *models.Allocation) error {
-	// Look for existing alloc
-	existing, err := txn.First("allocs", "id", alloc.ID)
-	if err != nil {
-		return fmt.Errorf("alloc lookup failed: %v", err)
+	var out []*models.Job
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		out = append(out, raw.(*models.Job))
 	}
+	return out, nil
+}
 
-	// Nothing to do if this does not exist
-	if existing == nil {
-		return nil
+// BlockingJobs returns all jobs along with the jobs table index once that
+// index exceeds minIndex, blocking until then. The list and the index are
+// read from the same transaction. It returns the context's error if ctx is
+// done first.
+func (s *StateStore) BlockingJobs(ctx context.Context, minIndex uint64) ([]*models.Job, uint64, error) {
+	for {
+		txn := s.db.Txn(false)
+		ws := memdb.NewWatchSet()
+
+		watchCh, existing, err := txn.FirstWatch("index", "id", "jobs")
+		if err != nil {
+			return nil, 0, fmt.Errorf("index lookup failed: %v", err)
+		}
+		ws.Add(watchCh)
+
+		var index uint64
+		if existing != nil {
+			index = existing.(*IndexEntry).Value
+		}
+		if index > minIndex {
+			var jobs []*models.Job
+			if err := IterateTable(txn, "jobs", "id", func(job *models.Job) error {
+				jobs = append(jobs, job)
+				return nil
+			}); err != nil {
+				return nil, 0, err
+			}
+			return jobs, index, nil
+		}
+
+		if err := ws.WatchCtx(ctx); err != nil {
+			return nil, 0, err
+		}
 	}
-	exist := existing.(*models.Allocation)
+}
 
-	// Copy everything from the existing allocation
-	copyAlloc := exist.Copy()
+// JobsTargetingNodeClass returns the jobs with a job or task level
+// constraint requiring ${node.class} to equal class. The scheduler doesn't
+// interpolate constraint targets, so this is a purely syntactic match on
+// the constraints as written; see jobTargetsNodeClass.
+func (s *StateStore) JobsTargetingNodeClass(ws memdb.WatchSet, class string) ([]*models.Job, error) {
+	txn := s.db.Txn(false)
 
-	// Pull in anything the client is the authority on
-	//if exist.DesiredStatus != models.AllocDesiredStatusPause {
-	copyAlloc.ClientStatus = alloc.ClientStatus
-	copyAlloc.ClientDescription = alloc.ClientDescription
-	copyAlloc.TaskStates = alloc.TaskStates
-	//}
+	iter, err := txn.Get("jobs", "id")
+	if err != nil {
+		return nil, fmt.Errorf("job lookup failed: %v", err)
+	}
 
-	// Update the modify index
-	copyAlloc.ModifyIndex = index
+	ws.Add(iter.WatchCh())
 
-	// Update the allocation
-	if err := txn.Insert("allocs", copyAlloc); err != nil {
-		return fmt.Errorf("alloc insert failed: %v", err)
+	var out []*models.Job
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		job := raw.(*models.Job)
+		if jobTargetsNodeClass(job, class) {
+			out = append(out, job)
+		}
 	}
+	return out, nil
+}
 
-	// Set the job's status
-	forceStatus := ""
-	if !copyAlloc.ClientTerminalStatus() {
-		switch copyAlloc.ClientStatus {
-		case models.AllocClientStatusPending:
-			forceStatus = models.JobStatusPending
+// jobTargetsNodeClass returns whether any of the job's constraints, or
+// those of its tasks, pins ${node.class} to class. A constraint matches only
+// if one target is exactly the literal string "${node.class}", the other is
+// exactly class and the operand is one of "=", "==" or "is". Any other
+// operand, such as "!=", "regexp" or "set_contains", is never treated as a
+// match, even when it would admit class.
+func jobTargetsNodeClass(job *models.Job, class string) bool {
+	var constraints []*models.Constraint
+	constraints = append(constraints, job.Constraints...)
+	for _, task := range job.Tasks {
+		constraints = append(constraints, task.Constraints...)
+	}
+	for _, c := range constraints {
+		if c == nil {
+			continue
+		}
+		switch c.Operand {
+		case "=", "==", "is":
 		default:
-			forceStatus = models.JobStatusRunning
+			continue
+		}
+		if (c.LTarget == "${node.class}" && c.RTarget == class) ||
+			(c.RTarget == "${node.class}" && c.LTarget == class) {
+			return true
 		}
-	} else {
-		forceStatus = models.JobStatusDead
-	}
-	jobs := map[string]string{exist.JobID: forceStatus}
-	if err := s.setJobStatuses(index, txn, jobs, false); err != nil {
-		return fmt.Errorf("setting job status failed: %v", err)
 	}
-	return nil
+	return false
 }
 
-// UpsertAllocs is used to evict a set of allocations
-// and allocate new ones at the same time.
-func (s *StateStore) UpsertAllocs(index uint64, allocs []*models.Allocation) error {
-	txn := s.db.Txn(true)
-	defer txn.Abort()
-
-	// Handle the allocations
-	jobs := make(map[string]string, 1)
-	for _, alloc := range allocs {
-		existing, err := txn.First("allocs", "id", alloc.ID)
-		if err != nil {
-			return fmt.Errorf("alloc lookup failed: %v", err)
-		}
-		exist, _ := existing.(*models.Allocation)
+// JobsByMinPriority returns the jobs whose priority is at least min, most
+// important first. The vendored memdb has no ordered range scans, so the
+// jobs table is walked rather than indexed by priority.
+func (s *StateStore) JobsByMinPriority(ws memdb.WatchSet, min int) ([]*models.Job, error) {
+	txn := s.db.Txn(false)
 
-		if exist == nil {
-			alloc.CreateIndex = index
-			alloc.ModifyIndex = index
-			alloc.AllocModifyIndex = index
-		} else {
-			alloc.CreateIndex = exist.CreateIndex
-			alloc.ModifyIndex = index
-			alloc.AllocModifyIndex = index
+	iter, err := txn.Get("jobs", "id")
+	if err != nil {
+		return nil, fmt.Errorf("job lookup failed: %v", err)
+	}
 
-			// If the scheduler is marking this allocation as lost we do not
-			// want to reuse the status of the existing allocation.
-			if alloc.ClientStatus != models.AllocClientStatusLost {
-				alloc.ClientStatus = exist.ClientStatus
-				alloc.ClientDescription = exist.ClientDescription
-			}
+	ws.Add(iter.WatchCh())
 
-			// The job has been denormalized so re-attach the original job
-			if alloc.Job == nil {
-				alloc.Job = exist.Job
-			}
+	var out []*models.Job
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		job := raw.(*models.Job)
+		if job.Priority >= min {
+			out = append(out, job)
 		}
+	}
 
-		if err := txn.Insert("allocs", alloc); err != nil {
-			return fmt.Errorf("alloc insert failed: %v", err)
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Priority != out[j].Priority {
+			return out[i].Priority > out[j].Priority
 		}
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
 
-		// If the allocation is running, force the job to running status.
-		forceStatus := ""
-		if !alloc.ClientTerminalStatus() {
-			forceStatus = models.JobStatusRunning
-		}
-		jobs[alloc.JobID] = forceStatus
+// JobsSubmittedBetween returns the jobs whose SubmitTime falls within
+// [from, to]. Jobs without a SubmitTime are skipped.
+func (s *StateStore) JobsSubmittedBetween(ws memdb.WatchSet, from, to time.Time) ([]*models.Job, error) {
+	txn := s.db.Txn(false)
+
+	iter, err := txn.Get("jobs", "id")
+	if err != nil {
+		return nil, fmt.Errorf("job lookup failed: %v", err)
 	}
 
-	// Update the indexes
-	if err := txn.Insert("index", &IndexEntry{"allocs", index}); err != nil {
-		return fmt.Errorf("index update failed: %v", err)
+	ws.Add(iter.WatchCh())
+
+	lo, hi := from.UnixNano(), to.UnixNano()
+	var out []*models.Job
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		job := raw.(*models.Job)
+		if job.SubmitTime == 0 {
+			continue
+		}
+		if job.SubmitTime >= lo && job.SubmitTime <= hi {
+			out = append(out, job)
+		}
 	}
+	return out, nil
+}
 
-	// Set the job's status
-	if err := s.setJobStatuses(index, txn, jobs, false); err != nil {
-		return fmt.Errorf("setting job status failed: %v", err)
+//order start
+func (s *StateStore) UpsertOrder(index uint64, order *models.Order) error {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	// Insert the job
+	if err := txn.Insert("orders", order); err != nil {
+		return fmt.Errorf("order insert failed: %v", err)
+	}
+	s.audit(txn, "UpsertOrder", "orders", order.ID, index)
+	if err := txn.Insert("index", &IndexEntry{"orders", index}); err != nil {
+		return fmt.Errorf("index update failed: %v", err)
 	}
 
 	txn.Commit()
 	return nil
 }
 
-func (s *StateStore) UpsertAlloc(index uint64, alloc *models.Allocation) error {
+// DeleteJob is used to deregister a job
+func (s *StateStore) DeleteOrder(index uint64, orderID string) error {
 	txn := s.db.Txn(true)
 	defer txn.Abort()
 
-	// Handle the allocations
-	jobs := make(map[string]string, 1)
-	existing, err := txn.First("allocs", "id", alloc.ID)
+	// Lookup the node
+	existing, err := txn.First("orders", "id", orderID)
 	if err != nil {
-		return fmt.Errorf("alloc lookup failed: %v", err)
+		return fmt.Errorf("order lookup failed: %v", err)
 	}
-	exist, _ := existing.(*models.Allocation)
-
-	if exist == nil {
-		alloc.CreateIndex = index
-		alloc.ModifyIndex = index
-		alloc.AllocModifyIndex = index
-	} else {
-		alloc.CreateIndex = exist.CreateIndex
-		alloc.ModifyIndex = index
-		alloc.AllocModifyIndex = index
-
-		// If the scheduler is marking this allocation as lost we do not
-		// want to reuse the status of the existing allocation.
-		if alloc.ClientStatus != models.AllocClientStatusLost {
-			alloc.ClientStatus = exist.ClientStatus
-			alloc.ClientDescription = exist.ClientDescription
-		}
-
-		// The job has been denormalized so re-attach the original job
-		if alloc.Job == nil {
-			alloc.Job = exist.Job
-		}
+	if existing == nil {
+		return fmt.Errorf("order not found")
 	}
 
-	if err := txn.Insert("allocs", alloc); err != nil {
-		return fmt.Errorf("alloc insert failed: %v", err)
-	}
+	// Delete the order
+	order := existing.(*models.Order)
 
-	// If the allocation is running, force the job to running status.
-	forceStatus := ""
-	if !alloc.ClientTerminalStatus() {
-		forceStatus = models.JobStatusRunning
+	if err := txn.Delete("orders", order); err != nil {
+		return fmt.Errorf("order delete failed: %v", err)
 	}
-	jobs[alloc.JobID] = forceStatus
-
-	// Update the indexes
-	if err := txn.Insert("index", &IndexEntry{"allocs", index}); err != nil {
+	s.audit(txn, "DeleteOrder", "orders", orderID, index)
+	if err := txn.Insert("index", &IndexEntry{"orders", index}); err != nil {
 		return fmt.Errorf("index update failed: %v", err)
 	}
 
-	// Set the job's status
-	if err := s.setJobStatuses(index, txn, jobs, false); err != nil {
-		return fmt.Errorf("setting job status failed: %v", err)
-	}
-
 	txn.Commit()
 	return nil
 }
 
-// AllocByID is used to lookup an allocation by its ID
-func (s *StateStore) AllocByID(ws memdb.WatchSet, id string) (*models.Allocation, error) {
+// JobByID is used to lookup a job by its ID
+func (s *StateStore) OrderByID(ws memdb.WatchSet, id string) (*models.Order, error) {
 	txn := s.db.Txn(false)
 
-	watchCh, existing, err := txn.FirstWatch("allocs", "id", id)
+	watchCh, existing, err := txn.FirstWatch("orders", "id", id)
 	if err != nil {
-		return nil, fmt.Errorf("alloc lookup failed: %v", err)
+		return nil, fmt.Errorf("Order lookup failed: %v", err)
 	}
-
 	ws.Add(watchCh)
 
 	if existing != nil {
-		return existing.(*models.Allocation), nil
+		if s.CopyOnRead {
+			return existing.(*models.Order).Copy(), nil
+		}
+		return existing.(*models.Order), nil
 	}
-
 	return nil, nil
 }
 
-// AllocsByIDPrefix is used to lookup allocs by prefix
-func (s *StateStore) AllocsByIDPrefix(ws memdb.WatchSet, id string) (memdb.ResultIterator, error) {
+// JobsByIDPrefix is used to lookup a job by prefix
+func (s *StateStore) OrdersByIDPrefix(ws memdb.WatchSet, id string) (memdb.ResultIterator, error) {
 	txn := s.db.Txn(false)
 
-	iter, err := txn.Get("allocs", "id_prefix", id)
+	iter, err := txn.Get("orders", "id_prefix", id)
 	if err != nil {
-		return nil, fmt.Errorf("alloc lookup failed: %v", err)
+		return nil, fmt.Errorf("job lookup failed: %v", err)
 	}
 
 	ws.Add(iter.WatchCh())
@@ -1203,38 +2031,1908 @@ func (s *StateStore) AllocsByIDPrefix(ws memdb.WatchSet, id string) (memdb.Resul
 	return iter, nil
 }
 
-// AllocsByNode returns all the allocations by node
-func (s *StateStore) AllocsByNode(ws memdb.WatchSet, node string) ([]*models.Allocation, error) {
+// Jobs returns an iterator over all the jobs
+func (s *StateStore) Orders(ws memdb.WatchSet) (memdb.ResultIterator, error) {
 	txn := s.db.Txn(false)
 
-	// Get an iterator over the node allocations, using only the
-	// node prefix which ignores the terminal status
-	iter, err := txn.Get("allocs", "node_prefix", node)
+	// Walk the entire jobs table
+	iter, err := txn.Get("orders", "id")
 	if err != nil {
 		return nil, err
 	}
 
 	ws.Add(iter.WatchCh())
 
-	var out []*models.Allocation
-	for {
-		raw := iter.Next()
-		if raw == nil {
-			break
-		}
-		if node == raw.(*models.Allocation).NodeID {
-			out = append(out, raw.(*models.Allocation))
+	return iter, nil
+}
+
+//order end
+
+// UpsertEvals is used to upsert a set of evaluations
+func (s *StateStore) UpsertEvals(index uint64, evals []*models.Evaluation) error {
+	return s.UpsertEvalsOpts(index, evals, true)
+}
+
+// UpsertEvalsOpts is used to upsert a set of evaluations. Restore-like
+// callers writing many evaluations can set recomputeStatus to false to skip
+// recomputing the status of the evaluations' jobs, and recompute it once
+// they are done instead.
+func (s *StateStore) UpsertEvalsOpts(index uint64, evals []*models.Evaluation, recomputeStatus bool) error {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	// Do a nested upsert
+	jobs := make(map[string]string, len(evals))
+	for _, eval := range evals {
+		if err := s.nestedUpsertEval(txn, index, eval); err != nil {
+			return err
+		}
+
+		jobs[eval.JobID] = ""
+	}
+
+	// Update the index once for the whole batch
+	if len(evals) != 0 {
+		if err := upsertIndex(txn, "evals", index); err != nil {
+			return err
+		}
+	}
+
+	// Set the job's status
+	if recomputeStatus {
+		if err := s.setJobStatuses(index, txn, jobs, false); err != nil {
+			return fmt.Errorf("setting job status failed: %v", err)
+		}
+	}
+
+	txn.Commit()
+	return nil
+}
+
+// nestedUpsertEvaluation is used to nest an evaluation upsert within a
+// transaction. The caller is responsible for updating the evals index.
+func (s *StateStore) nestedUpsertEval(txn *memdb.Txn, index uint64, eval *models.Evaluation) error {
+	// Lookup the evaluation
+	existing, err := txn.First("evals", "id", eval.ID)
+	if err != nil {
+		return fmt.Errorf("eval lookup failed: %v", err)
+	}
+
+	// Update the indexes
+	if existing != nil {
+		eval.CreateIndex = existing.(*models.Evaluation).CreateIndex
+		eval.ModifyIndex = index
+	} else {
+		eval.CreateIndex = index
+		eval.ModifyIndex = index
+	}
+
+	// Check if the job has any blocked evaluations and cancel them
+	if eval.Status == models.EvalStatusComplete && len(eval.FailedTGAllocs) == 0 {
+		// Get the blocked evaluation for a job if it exists
+		iter, err := txn.Get("evals", "job", eval.JobID, models.EvalStatusBlocked)
+		if err != nil {
+			return fmt.Errorf("failed to get blocked evals for job %q: %v", eval.JobID, err)
+		}
+
+		var blocked []*models.Evaluation
+		for {
+			raw := iter.Next()
+			if raw == nil {
+				break
+			}
+			blocked = append(blocked, raw.(*models.Evaluation))
+		}
+
+		// Go through and update the evals
+		for _, eval := range blocked {
+			newEval := eval.Copy()
+			newEval.Status = models.EvalStatusCancelled
+			newEval.StatusDescription = fmt.Sprintf("evaluation %q successful", newEval.ID)
+			newEval.ModifyIndex = index
+			if err := txn.Insert("evals", newEval); err != nil {
+				return fmt.Errorf("eval insert failed: %v", err)
+			}
+			s.audit(txn, "CancelBlockedEval", "evals", newEval.ID, index)
+		}
+	}
+
+	// Insert the eval
+	if err := txn.Insert("evals", eval); err != nil {
+		return fmt.Errorf("eval insert failed: %v", err)
+	}
+	s.audit(txn, "UpsertEvals", "evals", eval.ID, index)
+	return nil
+}
+
+// DeleteEval is used to delete an evaluation
+func (s *StateStore) DeleteEval(index uint64, evals []string, allocs []string) error {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	jobs := make(map[string]string, len(evals))
+	for _, eval := range evals {
+		existing, err := txn.First("evals", "id", eval)
+		if err != nil {
+			return fmt.Errorf("eval lookup failed: %v", err)
+		}
+		if existing == nil {
+			continue
+		}
+		if err := txn.Delete("evals", existing); err != nil {
+			return fmt.Errorf("eval delete failed: %v", err)
+		}
+		s.audit(txn, "DeleteEval", "evals", eval, index)
+		jobID := existing.(*models.Evaluation).JobID
+		jobs[jobID] = ""
+	}
+
+	for _, alloc := range allocs {
+		existing, err := txn.First("allocs", "id", alloc)
+		if err != nil {
+			return fmt.Errorf("alloc lookup failed: %v", err)
+		}
+		if existing == nil {
+			continue
+		}
+		if err := txn.Delete("allocs", existing); err != nil {
+			return fmt.Errorf("alloc delete failed: %v", err)
+		}
+		s.audit(txn, "DeleteEval", "allocs", alloc, index)
+		if err := s.deleteAllocStats(txn, index, alloc); err != nil {
+			return err
+		}
+	}
+
+	// Update the indexes
+	if err := txn.Insert("index", &IndexEntry{"evals", index}); err != nil {
+		return fmt.Errorf("index update failed: %v", err)
+	}
+	if err := txn.Insert("index", &IndexEntry{"allocs", index}); err != nil {
+		return fmt.Errorf("index update failed: %v", err)
+	}
+
+	// Set the job's status
+	if err := s.setJobStatuses(index, txn, jobs, true); err != nil {
+		return fmt.Errorf("setting job status failed: %v", err)
+	}
+
+	txn.Commit()
+	return nil
+}
+
+// DeleteEvalsByJob is used to delete every evaluation of a job in a single
+// transaction. The job status is recomputed as if the evals were garbage
+// collected. It returns the number of evaluations deleted.
+func (s *StateStore) DeleteEvalsByJob(index uint64, jobID string) (int, error) {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	iter, err := txn.Get("evals", "job_prefix", jobID)
+	if err != nil {
+		return 0, fmt.Errorf("eval lookup failed: %v", err)
+	}
+
+	var evals []*models.Evaluation
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		e := raw.(*models.Evaluation)
+
+		// Filter non-exact matches
+		if e.JobID != jobID {
+			continue
+		}
+		evals = append(evals, e)
+	}
+
+	if len(evals) == 0 {
+		return 0, nil
+	}
+
+	for _, eval := range evals {
+		if err := txn.Delete("evals", eval); err != nil {
+			return 0, fmt.Errorf("eval delete failed: %v", err)
+		}
+		s.audit(txn, "DeleteEvalsByJob", "evals", eval.ID, index)
+	}
+
+	// Update the indexes
+	if err := txn.Insert("index", &IndexEntry{"evals", index}); err != nil {
+		return 0, fmt.Errorf("index update failed: %v", err)
+	}
+
+	// Set the job's status
+	jobs := map[string]string{jobID: ""}
+	if err := s.setJobStatuses(index, txn, jobs, true); err != nil {
+		return 0, fmt.Errorf("setting job status failed: %v", err)
+	}
+
+	txn.Commit()
+	return len(evals), nil
+}
+
+// AckEval is used to record that a scheduler worker processed an evaluation
+// at the given index. The status of the evaluation is left unchanged.
+func (s *StateStore) AckEval(index uint64, evalID, workerID string) error {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	existing, err := txn.First("evals", "id", evalID)
+	if err != nil {
+		return fmt.Errorf("eval lookup failed: %v", err)
+	}
+	if existing == nil {
+		return fmt.Errorf("eval not found")
+	}
+
+	// Copy the existing eval and record the ack in the copy
+	eval := existing.(*models.Evaluation).Copy()
+	eval.ProcessedBy = workerID
+	eval.AckIndex = index
+	eval.ModifyIndex = index
+
+	if err := txn.Insert("evals", eval); err != nil {
+		return fmt.Errorf("eval insert failed: %v", err)
+	}
+	s.audit(txn, "AckEval", "evals", evalID, index)
+	if err := upsertIndex(txn, "evals", index); err != nil {
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+// EvalChain returns the chain of evaluations the given one belongs to,
+// newest first. The chain is followed forward through BlockedEval and
+// NextEval and backward through PreviousEval, stopping at links whose
+// evaluation no longer exists. An unknown evalID returns nil.
+func (s *StateStore) EvalChain(ws memdb.WatchSet, evalID string) ([]*models.Evaluation, error) {
+	txn := s.db.Txn(false)
+
+	lookup := func(id string) (*models.Evaluation, error) {
+		watchCh, existing, err := txn.FirstWatch("evals", "id", id)
+		if err != nil {
+			return nil, fmt.Errorf("eval lookup failed: %v", err)
+		}
+		ws.Add(watchCh)
+		if existing == nil {
+			return nil, nil
+		}
+		return existing.(*models.Evaluation), nil
+	}
+
+	eval, err := lookup(evalID)
+	if err != nil || eval == nil {
+		return nil, err
+	}
+
+	// Guard against cycles in malformed links
+	seen := map[string]bool{eval.ID: true}
+
+	var newer []*models.Evaluation
+	for cur := eval; ; {
+		next := cur.BlockedEval
+		if next == "" {
+			next = cur.NextEval
+		}
+		if next == "" || seen[next] {
+			break
+		}
+		if cur, err = lookup(next); err != nil {
+			return nil, err
+		} else if cur == nil {
+			break
+		}
+		seen[cur.ID] = true
+		newer = append(newer, cur)
+	}
+
+	out := make([]*models.Evaluation, 0, len(newer)+1)
+	for i := len(newer) - 1; i >= 0; i-- {
+		out = append(out, newer[i])
+	}
+	out = append(out, eval)
+
+	for cur := eval; cur.PreviousEval != "" && !seen[cur.PreviousEval]; {
+		if cur, err = lookup(cur.PreviousEval); err != nil {
+			return nil, err
+		} else if cur == nil {
+			break
+		}
+		seen[cur.ID] = true
+		out = append(out, cur)
+	}
+	return out, nil
+}
+
+// UnblockEvalsForJob moves the job's blocked evaluations back to pending so
+// they get scheduled again, returning how many were unblocked.
+func (s *StateStore) UnblockEvalsForJob(index uint64, jobID string) (int, error) {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	iter, err := txn.Get("evals", "job", jobID, models.EvalStatusBlocked)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get blocked evals for job %q: %v", jobID, err)
+	}
+
+	var blocked []*models.Evaluation
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		blocked = append(blocked, raw.(*models.Evaluation))
+	}
+	if len(blocked) == 0 {
+		return 0, nil
+	}
+
+	for _, eval := range blocked {
+		newEval := eval.Copy()
+		newEval.Status = models.EvalStatusPending
+		newEval.StatusDescription = ""
+		newEval.ModifyIndex = index
+		if err := txn.Insert("evals", newEval); err != nil {
+			return 0, fmt.Errorf("eval insert failed: %v", err)
+		}
+		s.audit(txn, "UnblockEvalsForJob", "evals", newEval.ID, index)
+	}
+	if err := upsertIndex(txn, "evals", index); err != nil {
+		return 0, err
+	}
+
+	// A pending eval may move the job back to pending
+	if err := s.setJobStatuses(index, txn, map[string]string{jobID: ""}, false); err != nil {
+		return 0, fmt.Errorf("setting job status failed: %v", err)
+	}
+
+	txn.Commit()
+	return len(blocked), nil
+}
+
+// EvalsUnacked returns the evaluations that no scheduler worker has acked
+func (s *StateStore) EvalsUnacked(ws memdb.WatchSet) ([]*models.Evaluation, error) {
+	txn := s.db.Txn(false)
+
+	iter, err := txn.Get("evals", "id")
+	if err != nil {
+		return nil, fmt.Errorf("eval lookup failed: %v", err)
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Evaluation
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		eval := raw.(*models.Evaluation)
+		if eval.ProcessedBy == "" {
+			out = append(out, eval)
+		}
+	}
+	return out, nil
+}
+
+// EvalByID is used to lookup an eval by its ID
+func (s *StateStore) EvalByID(ws memdb.WatchSet, id string) (*models.Evaluation, error) {
+	txn := s.db.Txn(false)
+
+	watchCh, existing, err := txn.FirstWatch("evals", "id", id)
+	if err != nil {
+		return nil, fmt.Errorf("eval lookup failed: %v", err)
+	}
+
+	ws.Add(watchCh)
+
+	if existing != nil {
+		if s.CopyOnRead {
+			return existing.(*models.Evaluation).Copy(), nil
+		}
+		return existing.(*models.Evaluation), nil
+	}
+	return nil, nil
+}
+
+// EvalsByIDPrefix is used to lookup evaluations by prefix
+func (s *StateStore) EvalsByIDPrefix(ws memdb.WatchSet, id string) (memdb.ResultIterator, error) {
+	txn := s.db.Txn(false)
+
+	iter, err := txn.Get("evals", "id_prefix", id)
+	if err != nil {
+		return nil, fmt.Errorf("eval lookup failed: %v", err)
+	}
+
+	ws.Add(iter.WatchCh())
+
+	return iter, nil
+}
+
+// EvalsByJob returns all the evaluations by job id
+func (s *StateStore) EvalsByJob(ws memdb.WatchSet, jobID string) ([]*models.Evaluation, error) {
+	txn := s.db.Txn(false)
+
+	// Get an iterator over the node allocations
+	iter, err := txn.Get("evals", "job_prefix", jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Evaluation
+	for {
+		raw := iter.Next()
+		if raw == nil {
+			break
+		}
+
+		e := raw.(*models.Evaluation)
+
+		// Filter non-exact matches
+		if e.JobID != jobID {
+			continue
+		}
+
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// ActivityEntry is a single entry in a job's activity timeline. Exactly one
+// of Eval and Alloc is set.
+type ActivityEntry struct {
+	// Index is the ModifyIndex of the eval or alloc
+	Index uint64
+
+	Eval  *models.Evaluation
+	Alloc *models.Allocation
+}
+
+// JobActivity returns the job's evaluations and allocations merged into a
+// single timeline ordered by ModifyIndex. When an eval and an alloc share an
+// index the eval comes first, since it is what placed the alloc.
+func (s *StateStore) JobActivity(ws memdb.WatchSet, jobID string) ([]ActivityEntry, error) {
+	txn := s.db.Txn(false)
+
+	evals, err := txn.Get("evals", "job_prefix", jobID)
+	if err != nil {
+		return nil, fmt.Errorf("eval lookup failed: %v", err)
+	}
+	ws.Add(evals.WatchCh())
+
+	var out []ActivityEntry
+	for raw := evals.Next(); raw != nil; raw = evals.Next() {
+		eval := raw.(*models.Evaluation)
+
+		// Filter non-exact matches
+		if eval.JobID != jobID {
+			continue
+		}
+		out = append(out, ActivityEntry{Index: eval.ModifyIndex, Eval: eval})
+	}
+
+	allocs, err := txn.Get("allocs", "job", jobID)
+	if err != nil {
+		return nil, fmt.Errorf("alloc lookup failed: %v", err)
+	}
+	ws.Add(allocs.WatchCh())
+
+	for raw := allocs.Next(); raw != nil; raw = allocs.Next() {
+		alloc := raw.(*models.Allocation)
+		out = append(out, ActivityEntry{Index: alloc.ModifyIndex, Alloc: alloc})
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Index != out[j].Index {
+			return out[i].Index < out[j].Index
+		}
+		return out[i].Eval != nil && out[j].Eval == nil
+	})
+	return out, nil
+}
+
+// EvalsByTrigger is used to lookup evaluations by what triggered them, such
+// as a job registration or a node update
+func (s *StateStore) EvalsByTrigger(ws memdb.WatchSet, trigger string) (memdb.ResultIterator, error) {
+	txn := s.db.Txn(false)
+
+	iter, err := txn.Get("evals", "trigger", trigger)
+	if err != nil {
+		return nil, err
+	}
+
+	ws.Add(iter.WatchCh())
+
+	return iter, nil
+}
+
+// BlockedEvals returns all the evaluations that are blocked awaiting
+// resources, across all jobs.
+func (s *StateStore) BlockedEvals(ws memdb.WatchSet) ([]*models.Evaluation, error) {
+	txn := s.db.Txn(false)
+
+	iter, err := txn.Get("evals", "status", models.EvalStatusBlocked)
+	if err != nil {
+		return nil, fmt.Errorf("eval lookup failed: %v", err)
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Evaluation
+	for {
+		raw := iter.Next()
+		if raw == nil {
+			break
+		}
+		out = append(out, raw.(*models.Evaluation))
+	}
+	return out, nil
+}
+
+// BlockedEvalsByClass returns the blocked evaluations that capacity in the
+// given computed node class could unblock. It follows the same rules as the
+// blocked evals tracker: an eval is returned if it escaped computed node
+// classes, if it is eligible for the class, or if it never saw the class.
+func (s *StateStore) BlockedEvalsByClass(ws memdb.WatchSet, class string) ([]*models.Evaluation, error) {
+	txn := s.db.Txn(false)
+
+	iter, err := txn.Get("evals", "status", models.EvalStatusBlocked)
+	if err != nil {
+		return nil, fmt.Errorf("eval lookup failed: %v", err)
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Evaluation
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		eval := raw.(*models.Evaluation)
+		if eval.EscapedComputedClass {
+			out = append(out, eval)
+			continue
+		}
+		if elig, ok := eval.ClassEligibility[class]; !ok || elig {
+			out = append(out, eval)
+		}
+	}
+	return out, nil
+}
+
+// EvalsByPriorityDesc returns the evaluations with the given status ordered
+// by priority, highest first. Evaluations of equal priority are ordered by
+// create index so older evaluations come first.
+func (s *StateStore) EvalsByPriorityDesc(ws memdb.WatchSet, status string) ([]*models.Evaluation, error) {
+	txn := s.db.Txn(false)
+
+	iter, err := txn.Get("evals", "status", status)
+	if err != nil {
+		return nil, fmt.Errorf("eval lookup failed: %v", err)
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Evaluation
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		out = append(out, raw.(*models.Evaluation))
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Priority != out[j].Priority {
+			return out[i].Priority > out[j].Priority
+		}
+		return out[i].CreateIndex < out[j].CreateIndex
+	})
+	return out, nil
+}
+
+// StuckEvals returns the pending and blocked evaluations that haven't been
+// modified since before olderThanIndex. Such evaluations made no progress
+// and usually point at a problem with the eval broker.
+func (s *StateStore) StuckEvals(ws memdb.WatchSet, olderThanIndex uint64) ([]*models.Evaluation, error) {
+	txn := s.db.Txn(false)
+
+	var out []*models.Evaluation
+	for _, status := range []string{models.EvalStatusPending, models.EvalStatusBlocked} {
+		iter, err := txn.Get("evals", "status", status)
+		if err != nil {
+			return nil, fmt.Errorf("eval lookup failed: %v", err)
+		}
+
+		ws.Add(iter.WatchCh())
+
+		for raw := iter.Next(); raw != nil; raw = iter.Next() {
+			eval := raw.(*models.Evaluation)
+			if eval.ModifyIndex < olderThanIndex {
+				out = append(out, eval)
+			}
+		}
+	}
+	return out, nil
+}
+
+// RecentEvals returns the n evaluations with the highest create index,
+// newest first. Evaluations created in the same batch are ordered by ID. The
+// evals table has no create index, and MemDB can't iterate in reverse, so
+// the whole table is sorted on read. A non-positive n returns all evals.
+func (s *StateStore) RecentEvals(ws memdb.WatchSet, n int) ([]*models.Evaluation, error) {
+	txn := s.db.Txn(false)
+
+	iter, err := txn.Get("evals", "id")
+	if err != nil {
+		return nil, fmt.Errorf("eval lookup failed: %v", err)
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Evaluation
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		out = append(out, raw.(*models.Evaluation))
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].CreateIndex != out[j].CreateIndex {
+			return out[i].CreateIndex > out[j].CreateIndex
+		}
+		return out[i].ID < out[j].ID
+	})
+	if n > 0 && n < len(out) {
+		out = out[:n]
+	}
+	return out, nil
+}
+
+// EvalsReady returns the pending evaluations that may be dequeued at now,
+// that is those without a WaitUntil or whose WaitUntil has passed.
+func (s *StateStore) EvalsReady(ws memdb.WatchSet, now time.Time) ([]*models.Evaluation, error) {
+	txn := s.db.Txn(false)
+
+	iter, err := txn.Get("evals", "status", models.EvalStatusPending)
+	if err != nil {
+		return nil, fmt.Errorf("eval lookup failed: %v", err)
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Evaluation
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		eval := raw.(*models.Evaluation)
+		if !eval.WaitUntil.IsZero() && eval.WaitUntil.After(now) {
+			continue
+		}
+		out = append(out, eval)
+	}
+	return out, nil
+}
+
+// EvalsWaitingUntilBefore returns the pending evaluations with a WaitUntil
+// earlier than t, soonest first. Evaluations without a WaitUntil are left
+// out; EvalsReady covers those.
+func (s *StateStore) EvalsWaitingUntilBefore(ws memdb.WatchSet, t time.Time) ([]*models.Evaluation, error) {
+	txn := s.db.Txn(false)
+
+	iter, err := txn.Get("evals", "status", models.EvalStatusPending)
+	if err != nil {
+		return nil, fmt.Errorf("eval lookup failed: %v", err)
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Evaluation
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		eval := raw.(*models.Evaluation)
+		if !eval.WaitUntil.IsZero() && eval.WaitUntil.Before(t) {
+			out = append(out, eval)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].WaitUntil.Equal(out[j].WaitUntil) {
+			return out[i].WaitUntil.Before(out[j].WaitUntil)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
+
+// Evals returns an iterator over all the evaluations
+func (s *StateStore) Evals(ws memdb.WatchSet) (memdb.ResultIterator, error) {
+	txn := s.db.Txn(false)
+
+	// Walk the entire table
+	iter, err := txn.Get("evals", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	ws.Add(iter.WatchCh())
+
+	return iter, nil
+}
+
+func (s *StateStore) UpdateJobFromClient(index uint64, job *models.Job) error {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	// Insert the job
+	if err := txn.Insert("jobs", job); err != nil {
+		return fmt.Errorf("job insert failed: %v", err)
+	}
+	if err := txn.Insert("index", &IndexEntry{"jobs", index}); err != nil {
+		return fmt.Errorf("index update failed: %v", err)
+	}
+	s.audit(txn, "UpdateJobFromClient", "jobs", job.ID, index)
+
+	txn.Commit()
+	return nil
+}
+
+// UpdateAllocsFromClient is used to update an allocation based on input
+// from a client. While the schedulers are the authority on the allocation for
+// most things, some updates are authoritative from the client. Specifically,
+// the desired store comes from the schedulers, while the actual store comes
+// from clients.
+func (s *StateStore) UpdateAllocsFromClient(index uint64, allocs []*models.Allocation) error {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	// Handle each of the updated allocations
+	for _, alloc := range allocs {
+		if err := s.nestedUpdateAllocFromClient(txn, index, alloc); err != nil {
+			return err
+		}
+	}
+
+	// Update the index once for the whole batch
+	if err := upsertIndex(txn, "allocs", index); err != nil {
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+// nestedUpdateAllocFromClient is used to nest an update of an allocation with client status
+func (s *StateStore) nestedUpdateAllocFromClient(txn *memdb.Txn, index uint64, alloc *models.Allocation) error {
+	// Look for existing alloc
+	existing, err := txn.First("allocs", "id", alloc.ID)
+	if err != nil {
+		return fmt.Errorf("alloc lookup failed: %v", err)
+	}
+
+	// Nothing to do if this does not exist
+	if existing == nil {
+		return nil
+	}
+	exist := existing.(*models.Allocation)
+
+	// A client terminal status is final. A delayed update that would move
+	// the allocation back to a live status is stale and dropped.
+	if exist.Terminated() && !alloc.Terminated() {
+		s.logger.Printf("[WARN] state_store: ignoring stale client status %q for alloc %s in terminal status %q",
+			alloc.ClientStatus, alloc.ID, exist.ClientStatus)
+		return nil
+	}
+
+	// Copy everything from the existing allocation
+	copyAlloc := exist.Copy()
+
+	// Pull in anything the client is the authority on. A paused allocation
+	// is frozen so late client updates don't override the server's view.
+	if exist.DesiredStatus != models.AllocDesiredStatusPause {
+		copyAlloc.ClientStatus = alloc.ClientStatus
+		copyAlloc.ClientDescription = alloc.ClientDescription
+		copyAlloc.TaskStates = alloc.TaskStates
+	}
+
+	// Update the modify index
+	copyAlloc.ModifyIndex = index
+
+	// Update the allocation
+	if err := txn.Insert("allocs", copyAlloc); err != nil {
+		return fmt.Errorf("alloc insert failed: %v", err)
+	}
+	s.audit(txn, "UpdateAllocsFromClient", "allocs", alloc.ID, index)
+
+	// Set the job's status
+	forceStatus := ""
+	if !copyAlloc.ClientTerminalStatus() {
+		switch copyAlloc.ClientStatus {
+		case models.AllocClientStatusPending:
+			forceStatus = models.JobStatusPending
+		default:
+			forceStatus = models.JobStatusRunning
+		}
+	} else {
+		forceStatus = models.JobStatusDead
+	}
+	jobs := map[string]string{exist.JobID: forceStatus}
+	if err := s.setJobStatuses(index, txn, jobs, false); err != nil {
+		return fmt.Errorf("setting job status failed: %v", err)
+	}
+	return nil
+}
+
+// SetAllocDesiredStatus is used to set the desired status of an allocation
+// from the server side. Once an allocation is paused, client updates no
+// longer modify its client status until the desired status changes again.
+func (s *StateStore) SetAllocDesiredStatus(index uint64, allocID, desired string) error {
+	switch desired {
+	case models.AllocDesiredStatusRun, models.AllocDesiredStatusPause,
+		models.AllocDesiredStatusStop, models.AllocDesiredStatusEvict:
+	default:
+		return fmt.Errorf("invalid desired status %q", desired)
+	}
+
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	existing, err := txn.First("allocs", "id", allocID)
+	if err != nil {
+		return fmt.Errorf("alloc lookup failed: %v", err)
+	}
+	if existing == nil {
+		return fmt.Errorf("alloc not found")
+	}
+
+	// Copy the existing allocation and update the desired status
+	exist := existing.(*models.Allocation)
+	copyAlloc := exist.Copy()
+	copyAlloc.DesiredStatus = desired
+	copyAlloc.MaintenancePaused = false
+	trackDesiredStatus(copyAlloc, exist)
+	copyAlloc.ModifyIndex = index
+	copyAlloc.AllocModifyIndex = index
+
+	if err := txn.Insert("allocs", copyAlloc); err != nil {
+		return fmt.Errorf("alloc insert failed: %v", err)
+	}
+	s.audit(txn, "SetAllocDesiredStatus", "allocs", allocID, index)
+	if err := txn.Insert("index", &IndexEntry{"allocs", index}); err != nil {
+		return fmt.Errorf("index update failed: %v", err)
+	}
+
+	// If the allocation is running, force the job to running status.
+	forceStatus := ""
+	if !copyAlloc.ClientTerminalStatus() {
+		forceStatus = models.JobStatusRunning
+	}
+	jobs := map[string]string{copyAlloc.JobID: forceStatus}
+	if err := s.setJobStatuses(index, txn, jobs, false); err != nil {
+		return fmt.Errorf("setting job status failed: %v", err)
+	}
+
+	txn.Commit()
+	return nil
+}
+
+// UpsertAllocs is used to evict a set of allocations
+// and allocate new ones at the same time.
+func (s *StateStore) UpsertAllocs(index uint64, allocs []*models.Allocation) error {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	// Handle the allocations
+	jobs := make(map[string]string, 1)
+	for _, alloc := range allocs {
+		existing, err := txn.First("allocs", "id", alloc.ID)
+		if err != nil {
+			return fmt.Errorf("alloc lookup failed: %v", err)
+		}
+		exist, _ := existing.(*models.Allocation)
+
+		if exist == nil {
+			alloc.CreateIndex = index
+			alloc.ModifyIndex = index
+			alloc.AllocModifyIndex = index
+		} else {
+			alloc.CreateIndex = exist.CreateIndex
+			alloc.ModifyIndex = index
+			alloc.AllocModifyIndex = index
+
+			// If the scheduler is marking this allocation as lost we do not
+			// want to reuse the status of the existing allocation.
+			if alloc.ClientStatus != models.AllocClientStatusLost {
+				alloc.ClientStatus = exist.ClientStatus
+				alloc.ClientDescription = exist.ClientDescription
+			}
+
+			// The job has been denormalized so re-attach the original job
+			if alloc.Job == nil {
+				alloc.Job = exist.Job
+			}
+
+			trackDesiredStatus(alloc, exist)
+		}
+
+		if err := txn.Insert("allocs", alloc); err != nil {
+			return fmt.Errorf("alloc insert failed: %v", err)
+		}
+		s.audit(txn, "UpsertAllocs", "allocs", alloc.ID, index)
+
+		// If the allocation is running, force the job to running status.
+		forceStatus := ""
+		if !alloc.ClientTerminalStatus() {
+			forceStatus = models.JobStatusRunning
+		}
+		jobs[alloc.JobID] = forceStatus
+	}
+
+	// Update the indexes
+	if err := txn.Insert("index", &IndexEntry{"allocs", index}); err != nil {
+		return fmt.Errorf("index update failed: %v", err)
+	}
+
+	// Set the job's status
+	if err := s.setJobStatuses(index, txn, jobs, false); err != nil {
+		return fmt.Errorf("setting job status failed: %v", err)
+	}
+
+	txn.Commit()
+	return nil
+}
+
+func (s *StateStore) UpsertAlloc(index uint64, alloc *models.Allocation) error {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	// Handle the allocations
+	jobs := make(map[string]string, 1)
+	existing, err := txn.First("allocs", "id", alloc.ID)
+	if err != nil {
+		return fmt.Errorf("alloc lookup failed: %v", err)
+	}
+	exist, _ := existing.(*models.Allocation)
+
+	if exist == nil {
+		alloc.CreateIndex = index
+		alloc.ModifyIndex = index
+		alloc.AllocModifyIndex = index
+	} else {
+		alloc.CreateIndex = exist.CreateIndex
+		alloc.ModifyIndex = index
+		alloc.AllocModifyIndex = index
+
+		// If the scheduler is marking this allocation as lost we do not
+		// want to reuse the status of the existing allocation.
+		if alloc.ClientStatus != models.AllocClientStatusLost {
+			alloc.ClientStatus = exist.ClientStatus
+			alloc.ClientDescription = exist.ClientDescription
+		}
+
+		// The job has been denormalized so re-attach the original job
+		if alloc.Job == nil {
+			alloc.Job = exist.Job
+		}
+
+		trackDesiredStatus(alloc, exist)
+	}
+
+	if err := txn.Insert("allocs", alloc); err != nil {
+		return fmt.Errorf("alloc insert failed: %v", err)
+	}
+	s.audit(txn, "UpsertAlloc", "allocs", alloc.ID, index)
+
+	// If the allocation is running, force the job to running status.
+	forceStatus := ""
+	if !alloc.ClientTerminalStatus() {
+		forceStatus = models.JobStatusRunning
+	}
+	jobs[alloc.JobID] = forceStatus
+
+	// Update the indexes
+	if err := txn.Insert("index", &IndexEntry{"allocs", index}); err != nil {
+		return fmt.Errorf("index update failed: %v", err)
+	}
+
+	// Set the job's status
+	if err := s.setJobStatuses(index, txn, jobs, false); err != nil {
+		return fmt.Errorf("setting job status failed: %v", err)
+	}
+
+	txn.Commit()
+	return nil
+}
+
+// DeleteAllocs is used to delete a set of allocations in one transaction,
+// independently of their evaluations. Missing allocations are skipped. The
+// status of every affected job is recomputed.
+func (s *StateStore) DeleteAllocs(index uint64, allocIDs []string) error {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	jobs := make(map[string]string)
+	for _, allocID := range allocIDs {
+		existing, err := txn.First("allocs", "id", allocID)
+		if err != nil {
+			return fmt.Errorf("alloc lookup failed: %v", err)
+		}
+		if existing == nil {
+			continue
+		}
+		if err := txn.Delete("allocs", existing); err != nil {
+			return fmt.Errorf("alloc delete failed: %v", err)
+		}
+		s.audit(txn, "DeleteAllocs", "allocs", allocID, index)
+		if err := s.deleteAllocStats(txn, index, allocID); err != nil {
+			return err
+		}
+		jobs[existing.(*models.Allocation).JobID] = ""
+	}
+
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	// Update the indexes
+	if err := upsertIndex(txn, "allocs", index); err != nil {
+		return err
+	}
+
+	// Set the job's status
+	if err := s.setJobStatuses(index, txn, jobs, false); err != nil {
+		return fmt.Errorf("setting job status failed: %v", err)
+	}
+
+	txn.Commit()
+	return nil
+}
+
+// MarkAllocsLost sets the client status of the given allocations to lost,
+// as done when their node is found dead, and updates the status of the
+// affected jobs in the same transaction. Allocations that are missing or
+// already client terminal are skipped.
+func (s *StateStore) MarkAllocsLost(index uint64, allocIDs []string) error {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	jobs := make(map[string]string)
+	for _, allocID := range allocIDs {
+		existing, err := txn.First("allocs", "id", allocID)
+		if err != nil {
+			return fmt.Errorf("alloc lookup failed: %v", err)
+		}
+		if existing == nil {
+			continue
+		}
+		exist := existing.(*models.Allocation)
+		if exist.Terminated() {
+			continue
+		}
+		if err := s.nestedMarkAllocLost(txn, index, "MarkAllocsLost", exist); err != nil {
+			return err
+		}
+		jobs[exist.JobID] = ""
+	}
+
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	// Update the indexes
+	if err := upsertIndex(txn, "allocs", index); err != nil {
+		return err
+	}
+
+	// Set the job's status
+	if err := s.setJobStatuses(index, txn, jobs, false); err != nil {
+		return fmt.Errorf("setting job status failed: %v", err)
+	}
+
+	txn.Commit()
+	return nil
+}
+
+// nestedMarkAllocLost sets the client status of alloc to lost within a
+// transaction. The caller is responsible for the allocs index and the job
+// statuses.
+func (s *StateStore) nestedMarkAllocLost(txn *memdb.Txn, index uint64, method string, exist *models.Allocation) error {
+	alloc := exist.Copy()
+	alloc.ClientStatus = models.AllocClientStatusLost
+	alloc.ClientDescription = "alloc is lost since its node is down"
+	alloc.ModifyIndex = index
+	if err := txn.Insert("allocs", alloc); err != nil {
+		return fmt.Errorf("alloc insert failed: %v", err)
+	}
+	s.audit(txn, method, "allocs", alloc.ID, index)
+	return nil
+}
+
+// trackDesiredStatus records the desired status an allocation is moving
+// away from. If the desired status doesn't change, the previously recorded
+// value is carried over.
+func trackDesiredStatus(updated, exist *models.Allocation) {
+	if updated.DesiredStatus != exist.DesiredStatus {
+		updated.PreviousDesiredStatus = exist.DesiredStatus
+	} else {
+		updated.PreviousDesiredStatus = exist.PreviousDesiredStatus
+	}
+}
+
+// PruneJobAllocs deletes the oldest terminal allocations of a job, by
+// modify index, so that at most keep terminal allocations remain. Allocations
+// that are not terminal are never pruned. It returns the number of
+// allocations deleted.
+func (s *StateStore) PruneJobAllocs(index uint64, jobID string, keep int) (int, error) {
+	if keep < 0 {
+		return 0, fmt.Errorf("invalid number of allocations to keep: %d", keep)
+	}
+
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	iter, err := txn.Get("allocs", "job", jobID)
+	if err != nil {
+		return 0, fmt.Errorf("alloc lookup failed: %v", err)
+	}
+
+	var terminal []*models.Allocation
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		alloc := raw.(*models.Allocation)
+		if alloc.TerminalStatus() {
+			terminal = append(terminal, alloc)
+		}
+	}
+	if len(terminal) <= keep {
+		return 0, nil
+	}
+
+	// Oldest first
+	sort.Slice(terminal, func(i, j int) bool {
+		return terminal[i].ModifyIndex < terminal[j].ModifyIndex
+	})
+
+	pruned := terminal[:len(terminal)-keep]
+	for _, alloc := range pruned {
+		if err := txn.Delete("allocs", alloc); err != nil {
+			return 0, fmt.Errorf("alloc delete failed: %v", err)
+		}
+		s.audit(txn, "PruneJobAllocs", "allocs", alloc.ID, index)
+		if err := s.deleteAllocStats(txn, index, alloc.ID); err != nil {
+			return 0, err
+		}
+	}
+
+	// Update the indexes
+	if err := txn.Insert("index", &IndexEntry{"allocs", index}); err != nil {
+		return 0, fmt.Errorf("index update failed: %v", err)
+	}
+
+	// Set the job's status
+	jobs := map[string]string{jobID: ""}
+	if err := s.setJobStatuses(index, txn, jobs, false); err != nil {
+		return 0, fmt.Errorf("setting job status failed: %v", err)
+	}
+
+	txn.Commit()
+	return len(pruned), nil
+}
+
+// AllocByID is used to lookup an allocation by its ID
+func (s *StateStore) AllocByID(ws memdb.WatchSet, id string) (*models.Allocation, error) {
+	txn := s.db.Txn(false)
+
+	watchCh, existing, err := txn.FirstWatch("allocs", "id", id)
+	if err != nil {
+		return nil, fmt.Errorf("alloc lookup failed: %v", err)
+	}
+
+	ws.Add(watchCh)
+
+	if existing != nil {
+		if s.CopyOnRead {
+			return existing.(*models.Allocation).Copy(), nil
+		}
+		return existing.(*models.Allocation), nil
+	}
+
+	return nil, nil
+}
+
+// AllocsStaleClientStatus returns the non-terminal allocations last modified
+// before olderThanIndex. Client updates bump the ModifyIndex, so these are
+// allocations whose client may have stopped reporting.
+func (s *StateStore) AllocsStaleClientStatus(ws memdb.WatchSet, olderThanIndex uint64) ([]*models.Allocation, error) {
+	txn := s.db.Txn(false)
+
+	iter, err := txn.Get("allocs", "id")
+	if err != nil {
+		return nil, fmt.Errorf("alloc lookup failed: %v", err)
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Allocation
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		alloc := raw.(*models.Allocation)
+		if alloc.ModifyIndex < olderThanIndex && !alloc.TerminalStatus() {
+			out = append(out, alloc)
+		}
+	}
+	return out, nil
+}
+
+// MigratedAllocs returns the allocations placed on a different node than
+// the allocation they replace. Allocations whose predecessor has already
+// been garbage collected can't be resolved and are skipped.
+func (s *StateStore) MigratedAllocs(ws memdb.WatchSet) ([]*models.Allocation, error) {
+	txn := s.db.Txn(false)
+
+	iter, err := txn.Get("allocs", "id")
+	if err != nil {
+		return nil, fmt.Errorf("alloc lookup failed: %v", err)
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Allocation
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		alloc := raw.(*models.Allocation)
+		if alloc.PreviousAllocation == "" {
+			continue
+		}
+		prev, err := txn.First("allocs", "id", alloc.PreviousAllocation)
+		if err != nil {
+			return nil, fmt.Errorf("alloc lookup failed: %v", err)
+		}
+		if prev != nil && prev.(*models.Allocation).NodeID != alloc.NodeID {
+			out = append(out, alloc)
+		}
+	}
+	return out, nil
+}
+
+// UpsertAllocStats records the latest statistics reported for an
+// allocation, replacing any previous ones. The allocation must exist.
+func (s *StateStore) UpsertAllocStats(index uint64, stats *models.AllocStats) error {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	alloc, err := txn.First("allocs", "id", stats.AllocID)
+	if err != nil {
+		return fmt.Errorf("alloc lookup failed: %v", err)
+	}
+	if alloc == nil {
+		return fmt.Errorf("alloc not found")
+	}
+
+	existing, err := txn.First("alloc_stats", "id", stats.AllocID)
+	if err != nil {
+		return fmt.Errorf("alloc stats lookup failed: %v", err)
+	}
+	if existing != nil {
+		stats.CreateIndex = existing.(*models.AllocStats).CreateIndex
+	} else {
+		stats.CreateIndex = index
+	}
+	stats.ModifyIndex = index
+
+	if err := txn.Insert("alloc_stats", stats); err != nil {
+		return fmt.Errorf("alloc stats insert failed: %v", err)
+	}
+	s.audit(txn, "UpsertAllocStats", "alloc_stats", stats.AllocID, index)
+	if err := upsertIndex(txn, "alloc_stats", index); err != nil {
+		return err
+	}
+
+	txn.Commit()
+	return nil
+}
+
+// AllocStatsByID returns the latest statistics reported for an allocation
+func (s *StateStore) AllocStatsByID(ws memdb.WatchSet, allocID string) (*models.AllocStats, error) {
+	txn := s.db.Txn(false)
+
+	watchCh, existing, err := txn.FirstWatch("alloc_stats", "id", allocID)
+	if err != nil {
+		return nil, fmt.Errorf("alloc stats lookup failed: %v", err)
+	}
+
+	ws.Add(watchCh)
+
+	if existing != nil {
+		return existing.(*models.AllocStats), nil
+	}
+	return nil, nil
+}
+
+// AllAllocStats returns an iterator over the statistics of every allocation
+func (s *StateStore) AllAllocStats(ws memdb.WatchSet) (memdb.ResultIterator, error) {
+	txn := s.db.Txn(false)
+
+	// Walk the entire table
+	iter, err := txn.Get("alloc_stats", "id")
+	if err != nil {
+		return nil, err
+	}
+
+	ws.Add(iter.WatchCh())
+
+	return iter, nil
+}
+
+// deleteAllocStats removes the statistics of a deleted allocation, if any
+func (s *StateStore) deleteAllocStats(txn *memdb.Txn, index uint64, allocID string) error {
+	existing, err := txn.First("alloc_stats", "id", allocID)
+	if err != nil {
+		return fmt.Errorf("alloc stats lookup failed: %v", err)
+	}
+	if existing == nil {
+		return nil
+	}
+	if err := txn.Delete("alloc_stats", existing); err != nil {
+		return fmt.Errorf("alloc stats delete failed: %v", err)
+	}
+	s.audit(txn, "DeleteAllocStats", "alloc_stats", allocID, index)
+	return upsertIndex(txn, "alloc_stats", index)
+}
+
+// AllocsByIDPrefix is used to lookup allocs by prefix
+func (s *StateStore) AllocsByIDPrefix(ws memdb.WatchSet, id string) (memdb.ResultIterator, error) {
+	txn := s.db.Txn(false)
+
+	iter, err := txn.Get("allocs", "id_prefix", id)
+	if err != nil {
+		return nil, fmt.Errorf("alloc lookup failed: %v", err)
+	}
+
+	ws.Add(iter.WatchCh())
+
+	return iter, nil
+}
+
+// AllocsByNode returns all the allocations by node
+func (s *StateStore) AllocsByNode(ws memdb.WatchSet, node string) ([]*models.Allocation, error) {
+	txn := s.db.Txn(false)
+
+	// Get an iterator over the node allocations, using only the
+	// node prefix which ignores the terminal status
+	iter, err := txn.Get("allocs", "node_prefix", node)
+	if err != nil {
+		return nil, err
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Allocation
+	for {
+		raw := iter.Next()
+		if raw == nil {
+			break
+		}
+		if node == raw.(*models.Allocation).NodeID {
+			out = append(out, raw.(*models.Allocation))
+		}
+	}
+	return out, nil
+}
+
+// WatchNodeAllocs blocks until the allocations on the given node change
+// past minIndex and returns the new set along with the highest alloc
+// ModifyIndex on the node. Because removing an alloc doesn't raise that
+// maximum, a removal observed while blocked is reported with the allocs
+// table index instead. It returns the context's error if ctx is done first.
+func (s *StateStore) WatchNodeAllocs(ctx context.Context, nodeID string, minIndex uint64) ([]*models.Allocation, uint64, error) {
+	var prev map[string]struct{}
+	for {
+		ws := memdb.NewWatchSet()
+		allocs, err := s.AllocsByNode(ws, nodeID)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var index uint64
+		current := make(map[string]struct{}, len(allocs))
+		for _, alloc := range allocs {
+			current[alloc.ID] = struct{}{}
+			if alloc.ModifyIndex > index {
+				index = alloc.ModifyIndex
+			}
+		}
+		if index > minIndex {
+			return allocs, index, nil
+		}
+
+		for id := range prev {
+			if _, ok := current[id]; !ok {
+				index, err := s.Index("allocs")
+				if err != nil {
+					return nil, 0, err
+				}
+				return allocs, index, nil
+			}
+		}
+		prev = current
+
+		if err := ws.WatchCtx(ctx); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// WatchAllocDesiredStatus streams allocations whose desired status changes
+// after minIndex, so clients can act on stop and pause requests. There is no
+// event feed in this store, so changes are found by watching the allocs
+// table and comparing each alloc's desired status with the one last seen.
+// Allocs already modified past minIndex when the watch starts are reported
+// if their PreviousDesiredStatus shows a change. The channel is closed once
+// ctx is done or the store is abandoned, such as after a restore.
+func (s *StateStore) WatchAllocDesiredStatus(ctx context.Context, minIndex uint64) (<-chan *models.Allocation, error) {
+	abandonCh := s.AbandonCh()
+	ws := memdb.NewWatchSet()
+	ws.Add(abandonCh)
+	iter, err := s.Allocs(ws)
+	if err != nil {
+		return nil, fmt.Errorf("alloc lookup failed: %v", err)
+	}
+
+	seen := make(map[string]string)
+	var changed []*models.Allocation
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		alloc := raw.(*models.Allocation)
+		seen[alloc.ID] = alloc.DesiredStatus
+		if alloc.ModifyIndex > minIndex && alloc.PreviousDesiredStatus != "" &&
+			alloc.PreviousDesiredStatus != alloc.DesiredStatus {
+			changed = append(changed, alloc)
+		}
+	}
+
+	ch := make(chan *models.Allocation)
+	go func() {
+		defer close(ch)
+		for {
+			for _, alloc := range changed {
+				select {
+				case ch <- alloc:
+				case <-ctx.Done():
+					return
+				case <-abandonCh:
+					return
+				}
+			}
+			changed = nil
+
+			if err := ws.WatchCtx(ctx); err != nil {
+				return
+			}
+			select {
+			case <-abandonCh:
+				return
+			default:
+			}
+
+			ws = memdb.NewWatchSet()
+			ws.Add(abandonCh)
+			iter, err := s.Allocs(ws)
+			if err != nil {
+				s.logger.Printf("[ERR] state_store: alloc desired status watch failed: %v", err)
+				return
+			}
+
+			// Rebuild the seen set so deleted allocs are forgotten
+			current := make(map[string]string, len(seen))
+			for raw := iter.Next(); raw != nil; raw = iter.Next() {
+				alloc := raw.(*models.Allocation)
+				current[alloc.ID] = alloc.DesiredStatus
+				if prev, ok := seen[alloc.ID]; ok && prev != alloc.DesiredStatus {
+					changed = append(changed, alloc)
+				}
+			}
+			seen = current
+		}
+	}()
+	return ch, nil
+}
+
+// AllocCountsByNode returns the number of allocations on each node,
+// terminal ones included, computed in a single pass over the allocs table.
+// Nodes without allocations are left out of the map.
+func (s *StateStore) AllocCountsByNode(ws memdb.WatchSet) (map[string]int, error) {
+	txn := s.db.Txn(false)
+
+	iter, err := txn.Get("allocs", "id")
+	if err != nil {
+		return nil, fmt.Errorf("alloc lookup failed: %v", err)
+	}
+
+	ws.Add(iter.WatchCh())
+
+	counts := make(map[string]int)
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		counts[raw.(*models.Allocation).NodeID]++
+	}
+	return counts, nil
+}
+
+// NodeJobSummary returns, for each job with allocations on the given node,
+// the number of its allocations on that node, terminal ones included.
+func (s *StateStore) NodeJobSummary(ws memdb.WatchSet, nodeID string) (map[string]int, error) {
+	allocs, err := s.AllocsByNode(ws, nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("alloc lookup failed: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for _, alloc := range allocs {
+		counts[alloc.JobID]++
+	}
+	return counts, nil
+}
+
+// AllocsByNodeModifiedSince returns the allocations on a node that were
+// modified at or after minIndex. It lets a reconnecting client fetch only
+// what changed since the last index it saw.
+func (s *StateStore) AllocsByNodeModifiedSince(ws memdb.WatchSet, node string, minIndex uint64) ([]*models.Allocation, error) {
+	txn := s.db.Txn(false)
+
+	// Get an iterator over the node allocations, using only the
+	// node prefix which ignores the terminal status
+	iter, err := txn.Get("allocs", "node_prefix", node)
+	if err != nil {
+		return nil, err
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Allocation
+	for {
+		raw := iter.Next()
+		if raw == nil {
+			break
+		}
+		alloc := raw.(*models.Allocation)
+		if alloc.NodeID != node || alloc.ModifyIndex < minIndex {
+			continue
+		}
+		out = append(out, alloc)
+	}
+	return out, nil
+}
+
+// AllocsByNode returns all the allocations by node and terminal status
+func (s *StateStore) AllocsByNodeTerminal(ws memdb.WatchSet, node string, terminal bool) ([]*models.Allocation, error) {
+	txn := s.db.Txn(false)
+
+	// Get an iterator over the node allocations
+	iter, err := txn.Get("allocs", "node", node, terminal)
+	if err != nil {
+		return nil, err
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Allocation
+	for {
+		raw := iter.Next()
+		if raw == nil {
+			break
+		}
+		out = append(out, raw.(*models.Allocation))
+	}
+	return out, nil
+}
+
+// AllocsByJob returns all the allocations by job id
+func (s *StateStore) AllocsByJob(ws memdb.WatchSet, jobID string, all bool) ([]*models.Allocation, error) {
+	txn := s.db.Txn(false)
+
+	// Get the job
+	var job *models.Job
+	rawJob, err := txn.First("jobs", "id", jobID)
+	if err != nil {
+		return nil, err
+	}
+	if rawJob != nil {
+		job = rawJob.(*models.Job)
+	}
+
+	// Get an iterator over the node allocations
+	iter, err := txn.Get("allocs", "job", jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Allocation
+	for {
+		raw := iter.Next()
+		if raw == nil {
+			break
+		}
+
+		alloc := raw.(*models.Allocation)
+		if !allocOfJob(alloc, job, all) {
+			continue
+		}
+		out = append(out, alloc)
+	}
+	return out, nil
+}
+
+// allocOfJob reports whether an alloc found through the "job" index should be
+// returned for job. If the allocation belongs to a job with the same ID but a
+// different create index and we are not getting all the allocations whose
+// Jobs matches the same Job ID then we skip it. Allocations stored without
+// their job are keyed on JobID alone and always kept.
+func allocOfJob(alloc *models.Allocation, job *models.Job, all bool) bool {
+	if all || job == nil || alloc.Job == nil {
+		return true
+	}
+	return alloc.Job.CreateIndex == job.CreateIndex
+}
+
+// StaleAllocsForJob returns the allocations of a job that were created for
+// an earlier registration of it, i.e. whose embedded job has an older create
+// index than the job currently stored. Allocations without an embedded job
+// are never considered stale. If the job doesn't exist nothing is returned.
+func (s *StateStore) StaleAllocsForJob(ws memdb.WatchSet, jobID string) ([]*models.Allocation, error) {
+	txn := s.db.Txn(false)
+
+	watchCh, rawJob, err := txn.FirstWatch("jobs", "id", jobID)
+	if err != nil {
+		return nil, fmt.Errorf("job lookup failed: %v", err)
+	}
+	ws.Add(watchCh)
+	if rawJob == nil {
+		return nil, nil
+	}
+	job := rawJob.(*models.Job)
+
+	iter, err := txn.Get("allocs", "job", jobID)
+	if err != nil {
+		return nil, fmt.Errorf("alloc lookup failed: %v", err)
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Allocation
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		alloc := raw.(*models.Allocation)
+		if alloc.Job != nil && alloc.Job.CreateIndex < job.CreateIndex {
+			out = append(out, alloc)
+		}
+	}
+	return out, nil
+}
+
+// DeleteStaleAllocsForJob deletes the allocations of a job that were
+// created for an earlier registration of it, as reported by
+// StaleAllocsForJob, and recomputes the job status. It returns the number
+// of allocations deleted. Nothing is deleted if the job doesn't exist.
+func (s *StateStore) DeleteStaleAllocsForJob(index uint64, jobID string) (int, error) {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	rawJob, err := txn.First("jobs", "id", jobID)
+	if err != nil {
+		return 0, fmt.Errorf("job lookup failed: %v", err)
+	}
+	if rawJob == nil {
+		return 0, nil
+	}
+	job := rawJob.(*models.Job)
+
+	iter, err := txn.Get("allocs", "job", jobID)
+	if err != nil {
+		return 0, fmt.Errorf("alloc lookup failed: %v", err)
+	}
+
+	var stale []*models.Allocation
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		alloc := raw.(*models.Allocation)
+		if alloc.Job != nil && alloc.Job.CreateIndex < job.CreateIndex {
+			stale = append(stale, alloc)
+		}
+	}
+
+	if len(stale) == 0 {
+		return 0, nil
+	}
+
+	for _, alloc := range stale {
+		if err := txn.Delete("allocs", alloc); err != nil {
+			return 0, fmt.Errorf("alloc delete failed: %v", err)
+		}
+		s.audit(txn, "DeleteStaleAllocsForJob", "allocs", alloc.ID, index)
+		if err := s.deleteAllocStats(txn, index, alloc.ID); err != nil {
+			return 0, err
+		}
+	}
+
+	// Update the indexes
+	if err := upsertIndex(txn, "allocs", index); err != nil {
+		return 0, err
+	}
+
+	// Set the job's status
+	jobs := map[string]string{jobID: ""}
+	if err := s.setJobStatuses(index, txn, jobs, false); err != nil {
+		return 0, fmt.Errorf("setting job status failed: %v", err)
+	}
+
+	txn.Commit()
+	return len(stale), nil
+}
+
+// AllocCountByJob returns the number of allocations of a job without
+// materializing them. The all flag has the same meaning as for AllocsByJob.
+func (s *StateStore) AllocCountByJob(jobID string, all bool) (int, error) {
+	txn := s.db.Txn(false)
+
+	// Get the job
+	var job *models.Job
+	rawJob, err := txn.First("jobs", "id", jobID)
+	if err != nil {
+		return 0, err
+	}
+	if rawJob != nil {
+		job = rawJob.(*models.Job)
+	}
+
+	iter, err := txn.Get("allocs", "job", jobID)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		if allocOfJob(raw.(*models.Allocation), job, all) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// AllocsByJobDenormalized returns all the allocations by job id with their
+// job attached. Allocations whose job was denormalized away are returned as
+// copies with the job filled in from the jobs table, so the stored objects
+// are never modified.
+func (s *StateStore) AllocsByJobDenormalized(ws memdb.WatchSet, jobID string) ([]*models.Allocation, error) {
+	txn := s.db.Txn(false)
+
+	// Get the job
+	watchCh, rawJob, err := txn.FirstWatch("jobs", "id", jobID)
+	if err != nil {
+		return nil, fmt.Errorf("job lookup failed: %v", err)
+	}
+	ws.Add(watchCh)
+
+	var job *models.Job
+	if rawJob != nil {
+		job = rawJob.(*models.Job)
+	}
+
+	// Get an iterator over the job allocations
+	iter, err := txn.Get("allocs", "job", jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Allocation
+	for {
+		raw := iter.Next()
+		if raw == nil {
+			break
+		}
+
+		alloc := raw.(*models.Allocation)
+		if alloc.Job == nil && job != nil {
+			alloc = alloc.Copy()
+			alloc.Job = job
+		}
+		out = append(out, alloc)
+	}
+	return out, nil
+}
+
+// AllocsByClientStatusModifiedSince returns the allocations with the given
+// client status that were modified at or after minIndex. Pollers use it to
+// pick up only the allocations that changed since their last poll.
+func (s *StateStore) AllocsByClientStatusModifiedSince(ws memdb.WatchSet, status string, minIndex uint64) ([]*models.Allocation, error) {
+	txn := s.db.Txn(false)
+
+	iter, err := txn.Get("allocs", "client_status", status)
+	if err != nil {
+		return nil, err
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Allocation
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		alloc := raw.(*models.Allocation)
+		if alloc.ModifyIndex < minIndex {
+			continue
+		}
+		out = append(out, alloc)
+	}
+	return out, nil
+}
+
+// JobForAlloc returns the job currently stored for an allocation, which may
+// be newer than the copy embedded in the allocation. It returns nil if the
+// allocation or its job doesn't exist.
+func (s *StateStore) JobForAlloc(ws memdb.WatchSet, allocID string) (*models.Job, error) {
+	txn := s.db.Txn(false)
+
+	watchCh, existing, err := txn.FirstWatch("allocs", "id", allocID)
+	if err != nil {
+		return nil, fmt.Errorf("alloc lookup failed: %v", err)
+	}
+	ws.Add(watchCh)
+
+	if existing == nil {
+		return nil, nil
+	}
+
+	watchCh, job, err := txn.FirstWatch("jobs", "id", existing.(*models.Allocation).JobID)
+	if err != nil {
+		return nil, fmt.Errorf("job lookup failed: %v", err)
+	}
+	ws.Add(watchCh)
+
+	if job == nil {
+		return nil, nil
+	}
+	return job.(*models.Job), nil
+}
+
+// FollowupEvalForAlloc returns the follow-up evaluation created for an
+// allocation, or nil if the allocation doesn't exist or has none.
+func (s *StateStore) FollowupEvalForAlloc(ws memdb.WatchSet, allocID string) (*models.Evaluation, error) {
+	txn := s.db.Txn(false)
+
+	watchCh, existing, err := txn.FirstWatch("allocs", "id", allocID)
+	if err != nil {
+		return nil, fmt.Errorf("alloc lookup failed: %v", err)
+	}
+	ws.Add(watchCh)
+
+	if existing == nil {
+		return nil, nil
+	}
+	alloc := existing.(*models.Allocation)
+	if alloc.FollowupEvalID == "" {
+		return nil, nil
+	}
+
+	watchCh, eval, err := txn.FirstWatch("evals", "id", alloc.FollowupEvalID)
+	if err != nil {
+		return nil, fmt.Errorf("eval lookup failed: %v", err)
+	}
+	ws.Add(watchCh)
+
+	if eval == nil {
+		return nil, nil
+	}
+	return eval.(*models.Evaluation), nil
+}
+
+// AllocsByPreviousDesiredStatus returns the allocations whose desired
+// status last changed away from the given status, such as allocations that
+// were flipped from run to stop.
+func (s *StateStore) AllocsByPreviousDesiredStatus(ws memdb.WatchSet, status string) ([]*models.Allocation, error) {
+	txn := s.db.Txn(false)
+
+	iter, err := txn.Get("allocs", "id")
+	if err != nil {
+		return nil, fmt.Errorf("alloc lookup failed: %v", err)
+	}
+
+	ws.Add(iter.WatchCh())
+
+	var out []*models.Allocation
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		alloc := raw.(*models.Allocation)
+		if alloc.PreviousDesiredStatus == status {
+			out = append(out, alloc)
 		}
 	}
 	return out, nil
 }
 
-// AllocsByNode returns all the allocations by node and terminal status
-func (s *StateStore) AllocsByNodeTerminal(ws memdb.WatchSet, node string, terminal bool) ([]*models.Allocation, error) {
+// AllocsByEval returns all the allocations by eval id
+func (s *StateStore) AllocsByEval(ws memdb.WatchSet, evalID string) ([]*models.Allocation, error) {
 	txn := s.db.Txn(false)
 
-	// Get an iterator over the node allocations
-	iter, err := txn.Get("allocs", "node", node, terminal)
+	// Get an iterator over the eval allocations
+	iter, err := txn.Get("allocs", "eval", evalID)
 	if err != nil {
 		return nil, err
 	}
@@ -1252,66 +3950,50 @@ func (s *StateStore) AllocsByNodeTerminal(ws memdb.WatchSet, node string, termin
 	return out, nil
 }
 
-// AllocsByJob returns all the allocations by job id
-func (s *StateStore) AllocsByJob(ws memdb.WatchSet, jobID string, all bool) ([]*models.Allocation, error) {
+// AllocsByEvalPrefix is used to lookup allocs by a prefix of their eval ID.
+// The prefix scan uses the eval index, so no extra index is needed.
+func (s *StateStore) AllocsByEvalPrefix(ws memdb.WatchSet, evalPrefix string) (memdb.ResultIterator, error) {
 	txn := s.db.Txn(false)
 
-	// Get the job
-	var job *models.Job
-	rawJob, err := txn.First("jobs", "id", jobID)
-	if err != nil {
-		return nil, err
-	}
-	if rawJob != nil {
-		job = rawJob.(*models.Job)
-	}
-
-	// Get an iterator over the node allocations
-	iter, err := txn.Get("allocs", "job", jobID)
+	iter, err := txn.Get("allocs", "eval_prefix", evalPrefix)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("alloc lookup failed: %v", err)
 	}
 
 	ws.Add(iter.WatchCh())
 
-	var out []*models.Allocation
-	for {
-		raw := iter.Next()
-		if raw == nil {
-			break
-		}
-
-		alloc := raw.(*models.Allocation)
-		// If the allocation belongs to a job with the same ID but a different
-		// create index and we are not getting all the allocations whose Jobs
-		// matches the same Job ID then we skip it
-		if !all && job != nil && alloc.Job.CreateIndex != job.CreateIndex {
-			continue
-		}
-		out = append(out, raw.(*models.Allocation))
-	}
-	return out, nil
+	return iter, nil
 }
 
-// AllocsByEval returns all the allocations by eval id
-func (s *StateStore) AllocsByEval(ws memdb.WatchSet, evalID string) ([]*models.Allocation, error) {
+// DuplicateRunningAllocs returns the tasks that have more than one running
+// allocation. Each task of a job is placed as a single allocation, so any
+// duplicate indicates a scheduling bug. The result maps "jobID/task" to the
+// IDs of the running allocations.
+func (s *StateStore) DuplicateRunningAllocs(ws memdb.WatchSet) (map[string][]string, error) {
 	txn := s.db.Txn(false)
 
-	// Get an iterator over the eval allocations
-	iter, err := txn.Get("allocs", "eval", evalID)
+	iter, err := txn.Get("allocs", "id")
 	if err != nil {
 		return nil, err
 	}
 
 	ws.Add(iter.WatchCh())
 
-	var out []*models.Allocation
-	for {
-		raw := iter.Next()
-		if raw == nil {
-			break
+	running := make(map[string][]string)
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		alloc := raw.(*models.Allocation)
+		if alloc.TerminalStatus() || alloc.ClientStatus != models.AllocClientStatusRunning {
+			continue
+		}
+		key := alloc.JobID + "/" + alloc.Task
+		running[key] = append(running[key], alloc.ID)
+	}
+
+	out := make(map[string][]string)
+	for key, ids := range running {
+		if len(ids) > 1 {
+			out[key] = ids
 		}
-		out = append(out, raw.(*models.Allocation))
 	}
 	return out, nil
 }
@@ -1331,27 +4013,130 @@ func (s *StateStore) Allocs(ws memdb.WatchSet) (memdb.ResultIterator, error) {
 	return iter, nil
 }
 
-// LastIndex returns the greatest index value for all indexes
-func (s *StateStore) LatestIndex() (uint64, error) {
-	indexes, err := s.Indexes()
+// IterateTable walks every row of a table in the order of the given index,
+// calling fn with each row cast to T. Iteration stops at the first error
+// returned by fn, and a row that isn't a T is reported as an error rather
+// than panicking.
+func IterateTable[T any](txn *memdb.Txn, table, index string, fn func(T) error) error {
+	iter, err := txn.Get(table, index)
 	if err != nil {
-		return 0, err
+		return fmt.Errorf("%s lookup failed: %v", table, err)
 	}
 
-	var max uint64 = 0
-	for {
-		raw := indexes.Next()
-		if raw == nil {
-			break
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		obj, ok := raw.(T)
+		if !ok {
+			return fmt.Errorf("%s: unexpected row type %T", table, raw)
+		}
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stream sends the objects of iter on the returned channel as T and closes
+// the channel once the iterator is exhausted, when ctx is done or when it
+// meets an object that isn't a T. In the last case the error channel, which
+// is closed right after the object channel, receives an error first, so the
+// caller can tell a cut short stream from a complete one. The caller must
+// either drain the object channel or cancel ctx so the sending goroutine can
+// exit.
+func Stream[T any](ctx context.Context, iter memdb.ResultIterator) (<-chan T, <-chan error) {
+	ch := make(chan T)
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(errCh)
+		defer close(ch)
+		for raw := iter.Next(); raw != nil; raw = iter.Next() {
+			if ctx.Err() != nil {
+				return
+			}
+			obj, ok := raw.(T)
+			if !ok {
+				var want T
+				errCh <- fmt.Errorf("stream of %T met a %T", want, raw)
+				return
+			}
+			select {
+			case ch <- obj:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, errCh
+}
+
+// JobsChan streams all the jobs on a channel. See Stream.
+func (s *StateStore) JobsChan(ctx context.Context, ws memdb.WatchSet) (<-chan *models.Job, <-chan error, error) {
+	iter, err := s.Jobs(ws)
+	if err != nil {
+		return nil, nil, err
+	}
+	ch, errCh := Stream[*models.Job](ctx, iter)
+	return ch, errCh, nil
+}
+
+// upsertIndex sets the index entry of a table. Batch operations call it
+// once after all their objects are written rather than once per object.
+func upsertIndex(txn *memdb.Txn, table string, index uint64) error {
+	if err := txn.Insert("index", &IndexEntry{table, index}); err != nil {
+		return fmt.Errorf("index update failed: %v", err)
+	}
+	return nil
+}
+
+// BumpIndexes advances the index of each named table to index in a single
+// transaction, for callers that mutated several tables outside the regular
+// upsert methods. Indexes already at or past index are left alone. Unknown
+// tables are an error and nothing is written.
+func (s *StateStore) BumpIndexes(index uint64, tables []string) error {
+	schema := stateStoreSchema()
+	for _, table := range tables {
+		if _, ok := schema.Tables[table]; !ok || table == "index" {
+			return fmt.Errorf("unknown table %q", table)
+		}
+	}
+
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	for _, table := range tables {
+		existing, err := txn.First("index", "id", table)
+		if err != nil {
+			return fmt.Errorf("index lookup failed: %v", err)
 		}
+		if existing != nil && existing.(*IndexEntry).Value >= index {
+			continue
+		}
+		if err := upsertIndex(txn, table, index); err != nil {
+			return err
+		}
+		s.audit(txn, "BumpIndexes", "index", table, index)
+	}
+
+	txn.Commit()
+	return nil
+}
 
-		// Prepare the request struct
-		idx := raw.(*IndexEntry)
+// LastIndex returns the greatest index value for all indexes
+func (s *StateStore) LatestIndex() (uint64, error) {
+	return latestIndex(s.db.Txn(false))
+}
 
+// latestIndex returns the greatest index value seen by the transaction
+func latestIndex(txn *memdb.Txn) (uint64, error) {
+	var max uint64 = 0
+	err := IterateTable(txn, "index", "id", func(idx *IndexEntry) error {
 		// Determine the max
 		if idx.Value > max {
 			max = idx.Value
 		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
 
 	return max, nil
@@ -1397,6 +4182,151 @@ func (s *StateStore) Indexes() (memdb.ResultIterator, error) {
 	return iter, nil
 }
 
+// ClusterSummary holds the object counts shown on the dashboard
+type ClusterSummary struct {
+	// NodesByStatus counts nodes by their status
+	NodesByStatus map[string]int
+
+	// JobsByStatus counts jobs by their status
+	JobsByStatus map[string]int
+
+	// AllocsByClientStatus counts allocations by their client status
+	AllocsByClientStatus map[string]int
+
+	// Index is the latest index of the store
+	Index uint64
+}
+
+// ClusterSummary returns the counts of nodes, jobs and allocations by status
+// together with the latest index, all read from a single transaction.
+func (s *StateStore) ClusterSummary() (*ClusterSummary, error) {
+	txn := s.db.Txn(false)
+
+	out := &ClusterSummary{
+		NodesByStatus:        make(map[string]int),
+		JobsByStatus:         make(map[string]int),
+		AllocsByClientStatus: make(map[string]int),
+	}
+	if err := IterateTable(txn, "nodes", "id", func(node *models.Node) error {
+		out.NodesByStatus[node.Status]++
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := IterateTable(txn, "jobs", "id", func(job *models.Job) error {
+		out.JobsByStatus[job.Status]++
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := IterateTable(txn, "allocs", "id", func(alloc *models.Allocation) error {
+		out.AllocsByClientStatus[alloc.ClientStatus]++
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	index, err := latestIndex(txn)
+	if err != nil {
+		return nil, err
+	}
+	out.Index = index
+	return out, nil
+}
+
+// IndexTableKeys returns every key in the index table in key order. Each
+// mutation overwrites its table's entry, so anything beyond the table names
+// points at a stray insert.
+func (s *StateStore) IndexTableKeys() ([]string, error) {
+	txn := s.db.Txn(false)
+
+	var keys []string
+	if err := IterateTable(txn, "index", "id", func(idx *IndexEntry) error {
+		keys = append(keys, idx.Key)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// IndexMismatch describes a table whose entry in the index table is behind
+// the newest row stored in it.
+type IndexMismatch struct {
+	Table string
+
+	// Index is the value stored in the index table for Table
+	Index uint64
+
+	// MaxModifyIndex is the greatest ModifyIndex of the rows in Table
+	MaxModifyIndex uint64
+}
+
+// indexedTables are the tables whose rows carry a ModifyIndex
+var indexedTables = []string{"nodes", "jobs", "orders", "evals", "allocs", "alloc_stats"}
+
+// modifyIndexOf returns the ModifyIndex of a row stored in the state store
+func modifyIndexOf(raw interface{}) (uint64, bool) {
+	switch obj := raw.(type) {
+	case *models.Node:
+		return obj.ModifyIndex, true
+	case *models.Job:
+		return obj.ModifyIndex, true
+	case *models.Order:
+		return obj.ModifyIndex, true
+	case *models.Evaluation:
+		return obj.ModifyIndex, true
+	case *models.Allocation:
+		return obj.ModifyIndex, true
+	case *models.AllocStats:
+		return obj.ModifyIndex, true
+	default:
+		return 0, false
+	}
+}
+
+// IndexConsistency compares the index table against the rows of each table
+// and returns the tables whose index is lower than the greatest ModifyIndex
+// of their rows. Such a table breaks blocking queries, since watchers may
+// never observe the newest write. An index ahead of the rows is expected,
+// as deletes bump the index without leaving a row behind.
+func (s *StateStore) IndexConsistency() ([]IndexMismatch, error) {
+	txn := s.db.Txn(false)
+
+	var out []IndexMismatch
+	for _, table := range indexedTables {
+		iter, err := txn.Get(table, "id")
+		if err != nil {
+			return nil, fmt.Errorf("%s lookup failed: %v", table, err)
+		}
+
+		var max uint64
+		for raw := iter.Next(); raw != nil; raw = iter.Next() {
+			if modify, ok := modifyIndexOf(raw); ok && modify > max {
+				max = modify
+			}
+		}
+
+		var index uint64
+		entry, err := txn.First("index", "id", table)
+		if err != nil {
+			return nil, fmt.Errorf("index lookup failed: %v", err)
+		}
+		if entry != nil {
+			index = entry.(*IndexEntry).Value
+		}
+
+		if index < max {
+			out = append(out, IndexMismatch{
+				Table:          table,
+				Index:          index,
+				MaxModifyIndex: max,
+			})
+		}
+	}
+	return out, nil
+}
+
 // setJobStatuses is a helper for calling setJobStatus on multiple jobs by ID.
 // It takes a map of job IDs to an optional forceStatus string. It returns an
 // error if the job doesn't exist or setJobStatus fails.
@@ -1425,6 +4355,54 @@ func (s *StateStore) setJobStatuses(index uint64, txn *memdb.Txn,
 	return nil
 }
 
+// RecomputeAllJobStatuses recomputes the status of every job from its
+// evaluations and allocations in one transaction, for use after imports
+// that bypass the regular upsert methods. As in setJobStatuses, paused and
+// dead jobs are left alone. It returns how many jobs changed status.
+func (s *StateStore) RecomputeAllJobStatuses(index uint64) (int, error) {
+	txn := s.db.Txn(true)
+	defer txn.Abort()
+
+	var jobs []*models.Job
+	if err := IterateTable(txn, "jobs", "id", func(job *models.Job) error {
+		if job.Status != models.JobStatusPause && job.Status != models.JobStatusDead {
+			jobs = append(jobs, job)
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, job := range jobs {
+		status, err := s.getJobStatus(txn, job, false)
+		if err != nil {
+			return 0, err
+		}
+		if status == job.Status {
+			continue
+		}
+
+		updated := job.Copy()
+		updated.Status = status
+		updated.ModifyIndex = index
+		if err := txn.Insert("jobs", updated); err != nil {
+			return 0, fmt.Errorf("job insert failed: %v", err)
+		}
+		s.audit(txn, "RecomputeAllJobStatuses", "jobs", job.ID, index)
+		changed++
+	}
+
+	if changed != 0 {
+		if err := upsertIndex(txn, "jobs", index); err != nil {
+			return 0, err
+		}
+	}
+
+	txn.Commit()
+	return changed, nil
+}
+
 // setJobStatus sets the status of the job by looking up associated evaluations
 // and allocations. evalDelete should be set to true if setJobStatus is being
 // called because an evaluation is being deleted (potentially because of garbage
@@ -1463,6 +4441,7 @@ func (s *StateStore) setJobStatus(index uint64, txn *memdb.Txn,
 	if err := txn.Insert("jobs", updated); err != nil {
 		return fmt.Errorf("job insert failed: %v", err)
 	}
+	s.audit(txn, "SetJobStatus", "jobs", updated.ID, index)
 	if err := txn.Insert("index", &IndexEntry{"jobs", index}); err != nil {
 		return fmt.Errorf("index update failed: %v", err)
 	}
@@ -1517,6 +4496,85 @@ func (s *StateStore) getJobStatus(txn *memdb.Txn, job *models.Job, evalDelete bo
 // StateSnapshot is used to provide a point-in-time snapshot
 type StateSnapshot struct {
 	StateStore
+
+	// index is the latest index of the store the snapshot was taken from
+	index uint64
+}
+
+// SnapshotIndex returns the latest index of the store at the time the
+// snapshot was taken, i.e. what LatestIndex returned then: the greatest
+// value across every table in the index table, not that of any single
+// table. For a partial snapshot this covers every table, not only the ones
+// it holds. It is not named Index because the snapshot embeds StateStore,
+// whose Index(name) reports a single table, and it can't fail because the
+// value is captured when the snapshot is taken.
+func (s *StateSnapshot) SnapshotIndex() uint64 {
+	return s.index
+}
+
+// checksumTables is the canonical order in which tables are hashed. New
+// tables are appended so the per-table prefix of existing ones is stable.
+var checksumTables = []string{"index", "nodes", "jobs", "orders", "evals", "allocs", "alloc_stats"}
+
+// checksumHandle mirrors models.MsgpackHandle but encodes maps with sorted
+// keys so that equal objects always hash the same.
+var checksumHandle = func() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{RawToString: true}
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	h.Canonical = true
+	return h
+}()
+
+// Checksum returns a SHA-256 digest over every object in the snapshot.
+// Tables are walked in a fixed order and rows in primary key order, so two
+// snapshots holding the same objects produce the same checksum regardless
+// of the order the objects were inserted in.
+func (s *StateSnapshot) Checksum() (string, error) {
+	txn := s.db.Txn(false)
+	hash := sha256.New()
+	encoder := codec.NewEncoder(hash, checksumHandle)
+
+	for i, table := range checksumTables {
+		iter, err := txn.Get(table, "id")
+		if err != nil {
+			return "", fmt.Errorf("%s lookup failed: %v", table, err)
+		}
+		for raw := iter.Next(); raw != nil; raw = iter.Next() {
+			// Prefix each object with its table so rows can't collide
+			hash.Write([]byte{byte(i)})
+			if err := encoder.Encode(raw); err != nil {
+				return "", fmt.Errorf("%s encode failed: %v", table, err)
+			}
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ExportJSON writes the snapshot as a single indented JSON object with one
+// array per table. It is meant for inspection, such as in support bundles;
+// use the msgpack persist path to produce something that can be restored.
+func (s *StateSnapshot) ExportJSON(w io.Writer) error {
+	txn := s.db.Txn(false)
+
+	dump := make(map[string][]interface{}, len(checksumTables))
+	for _, table := range checksumTables {
+		iter, err := txn.Get(table, "id")
+		if err != nil {
+			return fmt.Errorf("%s lookup failed: %v", table, err)
+		}
+		rows := []interface{}{}
+		for raw := iter.Next(); raw != nil; raw = iter.Next() {
+			rows = append(rows, raw)
+		}
+		dump[table] = rows
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(dump); err != nil {
+		return fmt.Errorf("json encode failed: %v", err)
+	}
+	return nil
 }
 
 // StateRestore is used to optimize the performance when
@@ -1524,6 +4582,42 @@ type StateSnapshot struct {
 // instead of thousands of sub transactions
 type StateRestore struct {
 	txn *memdb.Txn
+
+	// timings accumulates the time spent inserting into each table. It is
+	// nil unless EnableTimings was called, in which case no clock is read.
+	timings map[string]time.Duration
+}
+
+// EnableTimings starts recording the cumulative insert time per table,
+// retrievable through Timings.
+func (r *StateRestore) EnableTimings() {
+	if r.timings == nil {
+		r.timings = make(map[string]time.Duration)
+	}
+}
+
+// Timings returns the cumulative insert time per table recorded since
+// EnableTimings was called, or nil if timings are disabled.
+func (r *StateRestore) Timings() map[string]time.Duration {
+	if r.timings == nil {
+		return nil
+	}
+	out := make(map[string]time.Duration, len(r.timings))
+	for table, d := range r.timings {
+		out[table] = d
+	}
+	return out
+}
+
+// insert inserts obj into table, timing it if timings are enabled
+func (r *StateRestore) insert(table string, obj interface{}) error {
+	if r.timings == nil {
+		return r.txn.Insert(table, obj)
+	}
+	start := time.Now()
+	err := r.txn.Insert(table, obj)
+	r.timings[table] += time.Since(start)
+	return err
 }
 
 // Abort is used to abort the restore operation
@@ -1538,7 +4632,7 @@ func (s *StateRestore) Commit() {
 
 // NodeRestore is used to restore a node
 func (r *StateRestore) NodeRestore(node *models.Node) error {
-	if err := r.txn.Insert("nodes", node); err != nil {
+	if err := r.insert("nodes", node); err != nil {
 		return fmt.Errorf("node insert failed: %v", err)
 	}
 	return nil
@@ -1546,15 +4640,23 @@ func (r *StateRestore) NodeRestore(node *models.Node) error {
 
 // JobRestore is used to restore a job
 func (r *StateRestore) JobRestore(job *models.Job) error {
-	if err := r.txn.Insert("jobs", job); err != nil {
+	if err := r.insert("jobs", job); err != nil {
 		return fmt.Errorf("job insert failed: %v", err)
 	}
 	return nil
 }
 
+// OrderRestore is used to restore an order
+func (r *StateRestore) OrderRestore(order *models.Order) error {
+	if err := r.insert("orders", order); err != nil {
+		return fmt.Errorf("order insert failed: %v", err)
+	}
+	return nil
+}
+
 // EvalRestore is used to restore an evaluation
 func (r *StateRestore) EvalRestore(eval *models.Evaluation) error {
-	if err := r.txn.Insert("evals", eval); err != nil {
+	if err := r.insert("evals", eval); err != nil {
 		return fmt.Errorf("eval insert failed: %v", err)
 	}
 	return nil
@@ -1562,16 +4664,83 @@ func (r *StateRestore) EvalRestore(eval *models.Evaluation) error {
 
 // AllocRestore is used to restore an allocation
 func (r *StateRestore) AllocRestore(alloc *models.Allocation) error {
-	if err := r.txn.Insert("allocs", alloc); err != nil {
+	if err := r.insert("allocs", alloc); err != nil {
 		return fmt.Errorf("alloc insert failed: %v", err)
 	}
 	return nil
 }
 
+// AllocStatsRestore is used to restore the statistics of an allocation
+func (r *StateRestore) AllocStatsRestore(stats *models.AllocStats) error {
+	if err := r.insert("alloc_stats", stats); err != nil {
+		return fmt.Errorf("alloc stats insert failed: %v", err)
+	}
+	return nil
+}
+
 // IndexRestore is used to restore an index
 func (r *StateRestore) IndexRestore(idx *IndexEntry) error {
-	if err := r.txn.Insert("index", idx); err != nil {
+	if err := r.insert("index", idx); err != nil {
 		return fmt.Errorf("index insert failed: %v", err)
 	}
 	return nil
 }
+
+// Restore dispatches obj to the typed restore method for the named table.
+// It is the single entry point for restore code that reads tagged objects
+// from a stream. Unknown tables and objects of the wrong type are errors.
+func (r *StateRestore) Restore(table string, obj interface{}) error {
+	if err := validateTableObject(table, obj); err != nil {
+		return err
+	}
+
+	switch table {
+	case "nodes":
+		return r.NodeRestore(obj.(*models.Node))
+	case "jobs":
+		return r.JobRestore(obj.(*models.Job))
+	case "orders":
+		return r.OrderRestore(obj.(*models.Order))
+	case "evals":
+		return r.EvalRestore(obj.(*models.Evaluation))
+	case "allocs":
+		return r.AllocRestore(obj.(*models.Allocation))
+	case "alloc_stats":
+		return r.AllocStatsRestore(obj.(*models.AllocStats))
+	default:
+		return r.IndexRestore(obj.(*IndexEntry))
+	}
+}
+
+// EnsureIndexes should be called before Commit. For every data table that
+// had no index entry restored, it sets the entry to the highest ModifyIndex
+// among the restored rows, so blocking queries keep working when a snapshot
+// is missing some index entries. Restored entries are left untouched.
+func (r *StateRestore) EnsureIndexes() error {
+	for _, table := range indexedTables {
+		existing, err := r.txn.First("index", "id", table)
+		if err != nil {
+			return fmt.Errorf("index lookup failed: %v", err)
+		}
+		if existing != nil {
+			continue
+		}
+
+		var max uint64
+		if err := IterateTable(r.txn, table, "id", func(raw interface{}) error {
+			if index, ok := modifyIndexOf(raw); ok && index > max {
+				max = index
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if max == 0 {
+			continue
+		}
+		if err := upsertIndex(r.txn, table, max); err != nil {
+			return err
+		}
+	}
+	return nil
+}
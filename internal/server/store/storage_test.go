@@ -0,0 +1,4862 @@
+/*
+ * Copyright (C) 2016-2018. ActionTech.
+ * Based on: github.com/hashicorp/nomad, github.com/github/gh-ost .
+ * License: MPL version 2: https://www.mozilla.org/en-US/MPL/2.0 .
+ */
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-memdb"
+
+	"github.com/actiontech/dtle/internal/models"
+)
+
+func testStateStore(t *testing.T) *StateStore {
+	state, err := NewStateStore(ioutil.Discard)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if state == nil {
+		t.Fatalf("missing state")
+	}
+	return state
+}
+
+func testNode() *models.Node {
+	return &models.Node{
+		ID:         models.GenerateUUID(),
+		Datacenter: "dc1",
+		Name:       "foobar",
+		Attributes: map[string]string{"kernel.name": "linux"},
+		Status:     models.NodeStatusReady,
+	}
+}
+
+func testJob() *models.Job {
+	return &models.Job{
+		Region:      "global",
+		ID:          models.GenerateUUID(),
+		Name:        "my-job",
+		Type:        models.JobTypeSync,
+		Datacenters: []string{"dc1"},
+		Tasks: []*models.Task{
+			{Type: models.TaskTypeSrc, Driver: "MySQL", Config: map[string]interface{}{}},
+			{Type: models.TaskTypeDest, Driver: "MySQL", Config: map[string]interface{}{}},
+		},
+		Status: models.JobStatusPending,
+	}
+}
+
+func testEval() *models.Evaluation {
+	return &models.Evaluation{
+		ID:          models.GenerateUUID(),
+		Type:        models.JobTypeSync,
+		TriggeredBy: models.EvalTriggerJobRegister,
+		JobID:       models.GenerateUUID(),
+		Status:      models.EvalStatusPending,
+	}
+}
+
+func testAlloc(job *models.Job, nodeID string) *models.Allocation {
+	return &models.Allocation{
+		ID:            models.GenerateUUID(),
+		EvalID:        models.GenerateUUID(),
+		NodeID:        nodeID,
+		Name:          "my-job.Src[0]",
+		JobID:         job.ID,
+		Job:           job,
+		Task:          models.TaskTypeSrc,
+		DesiredStatus: models.AllocDesiredStatusRun,
+		ClientStatus:  models.AllocClientStatusPending,
+	}
+}
+
+func watchFired(ws memdb.WatchSet) bool {
+	timedOut := ws.Watch(time.After(50 * time.Millisecond))
+	return !timedOut
+}
+
+func assertIndexConsistent(t *testing.T, state *StateStore) {
+	mismatches, err := state.IndexConsistency()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("index table out of sync: %#v", mismatches)
+	}
+}
+
+func TestStateStore_SetAllocDesiredStatus(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	if err := state.UpsertJob(1000, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	alloc := testAlloc(job, models.GenerateUUID())
+	if err := state.UpsertAllocs(1001, []*models.Allocation{alloc}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := state.SetAllocDesiredStatus(1002, alloc.ID, "bogus"); err == nil {
+		t.Fatalf("expected error for invalid desired status")
+	}
+	if err := state.SetAllocDesiredStatus(1002, models.GenerateUUID(), models.AllocDesiredStatusPause); err == nil {
+		t.Fatalf("expected error for missing alloc")
+	}
+	if err := state.SetAllocDesiredStatus(1002, alloc.ID, models.AllocDesiredStatusPause); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A client update after the pause must not overwrite the client status
+	update := alloc.Copy()
+	update.ClientStatus = models.AllocClientStatusFailed
+	update.ClientDescription = "late update"
+	if err := state.UpdateAllocsFromClient(1003, []*models.Allocation{update}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.AllocByID(ws, alloc.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.DesiredStatus != models.AllocDesiredStatusPause {
+		t.Fatalf("bad desired status: %v", out.DesiredStatus)
+	}
+	if out.ClientStatus != models.AllocClientStatusPending || out.ClientDescription != "" {
+		t.Fatalf("client status overwritten while paused: %#v", out)
+	}
+	if out.AllocModifyIndex != 1002 {
+		t.Fatalf("bad alloc modify index: %d", out.AllocModifyIndex)
+	}
+
+	// Resuming the allocation lets client updates through again
+	if err := state.SetAllocDesiredStatus(1004, alloc.ID, models.AllocDesiredStatusRun); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	update.ClientStatus = models.AllocClientStatusRunning
+	if err := state.UpdateAllocsFromClient(1005, []*models.Allocation{update}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err = state.AllocByID(ws, alloc.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.ClientStatus != models.AllocClientStatusRunning {
+		t.Fatalf("bad client status: %v", out.ClientStatus)
+	}
+
+	index, err := state.Index("allocs")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if index != 1005 {
+		t.Fatalf("bad index: %d", index)
+	}
+}
+
+func TestStateStore_RecentMutations(t *testing.T) {
+	state := testStateStore(t)
+	node := testNode()
+	job := testJob()
+	eval := testEval()
+	eval.JobID = job.ID
+
+	if err := state.UpsertNode(1000, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertJob(1001, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertEvals(1002, []*models.Evaluation{eval}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A failed write must not be recorded
+	if err := state.DeleteNode(1003, models.GenerateUUID()); err == nil {
+		t.Fatalf("expected error")
+	}
+	if err := state.DeleteNode(1004, node.ID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := []AuditEntry{
+		{Method: "UpsertNode", Table: "nodes", Key: node.ID, Index: 1000},
+		{Method: "SetJobStatus", Table: "jobs", Key: job.ID, Index: 1001},
+		{Method: "UpsertJob", Table: "jobs", Key: job.ID, Index: 1001},
+		{Method: "UpsertEvals", Table: "evals", Key: eval.ID, Index: 1002},
+		{Method: "DeleteNode", Table: "nodes", Key: node.ID, Index: 1004},
+	}
+	out := state.RecentMutations(0)
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	out = state.RecentMutations(2)
+	if !reflect.DeepEqual(out, expected[3:]) {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Snapshots never record mutations
+	snap, err := state.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out := snap.RecentMutations(0); len(out) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_RecentMutations_Cap(t *testing.T) {
+	state := testStateStore(t)
+	state.auditLog = newAuditLog(3)
+
+	var nodes []*models.Node
+	for i := 0; i < 5; i++ {
+		node := testNode()
+		nodes = append(nodes, node)
+		if err := state.UpsertNode(uint64(1000+i), node); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	out := state.RecentMutations(10)
+	if len(out) != 3 {
+		t.Fatalf("bad: %#v", out)
+	}
+	for i, entry := range out {
+		if entry.Key != nodes[i+2].ID || entry.Index != uint64(1002+i) {
+			t.Fatalf("bad entry %d: %#v", i, entry)
+		}
+	}
+}
+
+func TestStateStore_RecentMutations_Order(t *testing.T) {
+	state := testStateStore(t)
+
+	// Commits that flush out of index order are reported in index order
+	state.auditLog.flush([]AuditEntry{{Method: "A", Index: 1002}})
+	state.auditLog.flush([]AuditEntry{{Method: "B", Index: 1001}, {Method: "C", Index: 1001}})
+	state.auditLog.flush([]AuditEntry{{Method: "D", Index: 1003}})
+
+	var methods []string
+	for _, entry := range state.RecentMutations(0) {
+		methods = append(methods, entry.Method)
+	}
+	if !reflect.DeepEqual(methods, []string{"B", "C", "A", "D"}) {
+		t.Fatalf("bad: %v", methods)
+	}
+
+	out := state.RecentMutations(2)
+	if len(out) != 2 || out[0].Method != "A" || out[1].Method != "D" {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_RecentMutations_Sites(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	blocked := testEval()
+	blocked.JobID = job.ID
+	blocked.Status = models.EvalStatusBlocked
+	eval := testEval()
+	eval.JobID = job.ID
+	eval.Status = models.EvalStatusComplete
+	alloc := testAlloc(job, models.GenerateUUID())
+	if err := state.UpsertJob(1000, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertEvals(1000, []*models.Evaluation{blocked}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertEvals(1001, []*models.Evaluation{eval}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertAllocs(1002, []*models.Allocation{alloc}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Each of these writes must show up in the audit log
+	newID := models.GenerateUUID()
+	if err := state.RenameJob(1003, job.ID, newID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.BumpIndexes(1004, []string{"nodes"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	node := testNode()
+	node.ModifyIndex = 1005
+	if err := state.RestoreTable("nodes", []interface{}{node}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Orders are claimed, renewed and released along with their job
+	done := &models.Order{ID: models.GenerateUUID()}
+	pending := &models.Order{ID: models.GenerateUUID()}
+	renewed := &models.Order{ID: models.GenerateUUID()}
+	for _, order := range []*models.Order{done, pending, renewed} {
+		if err := state.UpsertOrder(1006, order); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	ordered := testJob()
+	ordered.Orders = []string{done.ID, pending.ID}
+	if err := state.UpsertJob(1007, ordered); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.RenewalJob(1008, ordered.ID, renewed.ID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	finished := &models.Order{ID: done.ID, JobID: ordered.ID, Status: models.OrderStatusDone}
+	if err := state.UpsertOrder(1009, finished); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.DeleteJob(1010, ordered.ID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Deleting a job cascades to its evals and allocs
+	if err := state.DeleteJob(1011, newID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := map[AuditEntry]bool{
+		{Method: "CancelBlockedEval", Table: "evals", Key: blocked.ID, Index: 1001}: true,
+		{Method: "SetJobStatus", Table: "jobs", Key: job.ID, Index: 1002}:           true,
+		{Method: "RenameJob", Table: "jobs", Key: newID, Index: 1003}:               true,
+		{Method: "RenameJob", Table: "evals", Key: eval.ID, Index: 1003}:            true,
+		{Method: "RenameJob", Table: "allocs", Key: alloc.ID, Index: 1003}:          true,
+		{Method: "BumpIndexes", Table: "index", Key: "nodes", Index: 1004}:          true,
+		{Method: "RestoreTable", Table: "nodes", Key: "", Index: 1005}:              true,
+		{Method: "UpsertJob", Table: "orders", Key: done.ID, Index: 1007}:           true,
+		{Method: "UpsertJob", Table: "orders", Key: pending.ID, Index: 1007}:        true,
+		{Method: "RenewalJob", Table: "orders", Key: renewed.ID, Index: 1008}:       true,
+		{Method: "ReleaseJobOrders", Table: "orders", Key: done.ID, Index: 1010}:    true,
+		{Method: "ReleaseJobOrders", Table: "orders", Key: pending.ID, Index: 1010}: true,
+		{Method: "ReleaseJobOrders", Table: "orders", Key: renewed.ID, Index: 1010}: true,
+		{Method: "DeleteJob", Table: "evals", Key: eval.ID, Index: 1011}:            true,
+		{Method: "DeleteJob", Table: "allocs", Key: alloc.ID, Index: 1011}:          true,
+	}
+	for _, entry := range state.RecentMutations(0) {
+		delete(expected, entry)
+	}
+	if len(expected) != 0 {
+		t.Fatalf("missing: %#v", expected)
+	}
+}
+
+func TestStateStore_AllocsByJobDenormalized(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	if err := state.UpsertJob(1000, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	full := testAlloc(job, models.GenerateUUID())
+	stripped := testAlloc(job, models.GenerateUUID())
+	stripped.Job = nil
+	if err := state.UpsertAllocs(1001, []*models.Allocation{full, stripped}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.AllocsByJobDenormalized(ws, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("bad: %#v", out)
+	}
+	for _, alloc := range out {
+		if alloc.Job == nil || alloc.Job.ID != job.ID {
+			t.Fatalf("alloc %s missing job", alloc.ID)
+		}
+	}
+
+	// The stored allocation must not have been mutated
+	stored, err := state.AllocByID(ws, stripped.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stored.Job != nil {
+		t.Fatalf("stored alloc was mutated")
+	}
+}
+
+func TestStateSnapshot_Checksum(t *testing.T) {
+	state := testStateStore(t)
+	node := testNode()
+	job := testJob()
+	eval := testEval()
+	eval.JobID = job.ID
+	alloc := testAlloc(job, node.ID)
+
+	if err := state.UpsertNode(1000, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertJob(1001, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertEvals(1002, []*models.Evaluation{eval}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertAllocs(1003, []*models.Allocation{alloc}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	snap, err := state.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sum, err := snap.Checksum()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Round-trip the snapshot into a new store, inserting in reverse order
+	restored := testStateStore(t)
+	restore, err := restored.Restore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ws := memdb.NewWatchSet()
+	allocs, _ := snap.Allocs(ws)
+	for raw := allocs.Next(); raw != nil; raw = allocs.Next() {
+		if err := restore.AllocRestore(raw.(*models.Allocation)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	evals, _ := snap.Evals(ws)
+	for raw := evals.Next(); raw != nil; raw = evals.Next() {
+		if err := restore.EvalRestore(raw.(*models.Evaluation)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	jobs, _ := snap.Jobs(ws)
+	for raw := jobs.Next(); raw != nil; raw = jobs.Next() {
+		if err := restore.JobRestore(raw.(*models.Job)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	nodes, _ := snap.Nodes(ws)
+	for raw := nodes.Next(); raw != nil; raw = nodes.Next() {
+		if err := restore.NodeRestore(raw.(*models.Node)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	indexes, _ := snap.Indexes()
+	for raw := indexes.Next(); raw != nil; raw = indexes.Next() {
+		if err := restore.IndexRestore(raw.(*IndexEntry)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	restore.Commit()
+
+	restoredSnap, err := restored.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	restoredSum, err := restoredSnap.Checksum()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if restoredSum != sum {
+		t.Fatalf("checksum mismatch after round-trip: %s != %s", restoredSum, sum)
+	}
+
+	// Mutating a single object changes the checksum
+	if err := restored.UpdateNodeStatus(1004, node.ID, models.NodeStatusDown, 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	mutatedSnap, err := restored.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	mutatedSum, err := mutatedSnap.Checksum()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if mutatedSum == sum {
+		t.Fatalf("checksum unchanged after mutation")
+	}
+}
+
+func TestStateStore_AllocsByNodeModifiedSince(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	nodeID := models.GenerateUUID()
+	otherNodeID := models.GenerateUUID()
+
+	old := testAlloc(job, nodeID)
+	changed := testAlloc(job, nodeID)
+	other := testAlloc(job, otherNodeID)
+	if err := state.UpsertAllocs(1000, []*models.Allocation{old, changed, other}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	update := changed.Copy()
+	update.ClientStatus = models.AllocClientStatusRunning
+	otherUpdate := other.Copy()
+	otherUpdate.ClientStatus = models.AllocClientStatusRunning
+	if err := state.UpdateAllocsFromClient(1005, []*models.Allocation{update, otherUpdate}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.AllocsByNodeModifiedSince(ws, nodeID, 1001)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 1 || out[0].ID != changed.ID {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	out, err = state.AllocsByNodeModifiedSince(ws, nodeID, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_BlockedEvals(t *testing.T) {
+	state := testStateStore(t)
+
+	blocked1 := testEval()
+	blocked1.Status = models.EvalStatusBlocked
+	blocked2 := testEval()
+	blocked2.Status = models.EvalStatusBlocked
+	pending := testEval()
+	complete := testEval()
+	complete.Status = models.EvalStatusComplete
+
+	evals := []*models.Evaluation{blocked1, blocked2, pending, complete}
+	if err := state.UpsertEvals(1000, evals); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.BlockedEvals(ws)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("bad: %#v", out)
+	}
+	for _, eval := range out {
+		if eval.ID != blocked1.ID && eval.ID != blocked2.ID {
+			t.Fatalf("unexpected eval: %#v", eval)
+		}
+	}
+
+	// Unblocking an eval fires the watch
+	update := blocked1.Copy()
+	update.Status = models.EvalStatusPending
+	if err := state.UpsertEvals(1001, []*models.Evaluation{update}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+}
+
+func TestStateStore_PruneJobAllocs(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	if err := state.UpsertJob(1000, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Ten terminal allocs, each written at its own index, plus a live one
+	var terminal []*models.Allocation
+	for i := 0; i < 10; i++ {
+		alloc := testAlloc(job, models.GenerateUUID())
+		alloc.DesiredStatus = models.AllocDesiredStatusStop
+		terminal = append(terminal, alloc)
+		if err := state.UpsertAllocs(uint64(1001+i), []*models.Allocation{alloc}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	live := testAlloc(job, models.GenerateUUID())
+	if err := state.UpsertAllocs(1011, []*models.Allocation{live}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := state.PruneJobAllocs(1012, job.ID, -1); err == nil {
+		t.Fatalf("expected error")
+	}
+	pruned, err := state.PruneJobAllocs(1012, job.ID, 3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if pruned != 7 {
+		t.Fatalf("bad: %d", pruned)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.AllocsByJob(ws, job.ID, true)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	remaining := make(map[string]bool)
+	for _, alloc := range out {
+		remaining[alloc.ID] = true
+	}
+	if len(remaining) != 4 || !remaining[live.ID] {
+		t.Fatalf("bad: %#v", out)
+	}
+	for _, alloc := range terminal[7:] {
+		if !remaining[alloc.ID] {
+			t.Fatalf("newest terminal alloc %s was pruned", alloc.ID)
+		}
+	}
+
+	index, err := state.Index("allocs")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if index != 1012 {
+		t.Fatalf("bad index: %d", index)
+	}
+
+	// Nothing left to prune
+	pruned, err = state.PruneJobAllocs(1013, job.ID, 3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if pruned != 0 {
+		t.Fatalf("bad: %d", pruned)
+	}
+
+	assertIndexConsistent(t, state)
+}
+
+func TestStateStore_RenameJob(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	order := &models.Order{ID: models.GenerateUUID()}
+	job.Orders = []string{order.ID}
+	if err := state.UpsertOrder(999, order); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertJob(1000, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	oldID := job.ID
+
+	eval := testEval()
+	eval.JobID = oldID
+	if err := state.UpsertEvals(1001, []*models.Evaluation{eval}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	alloc := testAlloc(job, models.GenerateUUID())
+	if err := state.UpsertAllocs(1002, []*models.Allocation{alloc}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	taken := testJob()
+	if err := state.UpsertJob(1003, taken); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.RenameJob(1004, oldID, taken.ID); err == nil {
+		t.Fatalf("expected error renaming onto an existing job")
+	}
+	if err := state.RenameJob(1004, models.GenerateUUID(), "new"); err == nil {
+		t.Fatalf("expected error renaming a missing job")
+	}
+
+	newID := "renamed-job"
+	if err := state.RenameJob(1005, oldID, newID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	if out, _ := state.JobByID(ws, oldID); out != nil {
+		t.Fatalf("old job still present: %#v", out)
+	}
+	out, err := state.JobByID(ws, newID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out == nil || out.CreateIndex != 1000 || out.ModifyIndex != 1005 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	if evals, _ := state.EvalsByJob(ws, oldID); len(evals) != 0 {
+		t.Fatalf("evals left behind: %#v", evals)
+	}
+	evals, err := state.EvalsByJob(ws, newID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(evals) != 1 || evals[0].ID != eval.ID {
+		t.Fatalf("bad: %#v", evals)
+	}
+
+	if allocs, _ := state.AllocsByJob(ws, oldID, true); len(allocs) != 0 {
+		t.Fatalf("allocs left behind: %#v", allocs)
+	}
+	allocs, err := state.AllocsByJob(ws, newID, true)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(allocs) != 1 || allocs[0].ID != alloc.ID || allocs[0].Job.ID != newID {
+		t.Fatalf("bad: %#v", allocs)
+	}
+
+	// No duplicates left in the tables
+	iter, err := state.Allocs(ws)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	count := 0
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		count++
+	}
+	if count != 1 {
+		t.Fatalf("bad alloc count: %d", count)
+	}
+
+	outOrder, err := state.OrderByID(ws, order.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if outOrder.JobID != newID {
+		t.Fatalf("bad order job: %q", outOrder.JobID)
+	}
+
+	assertIndexConsistent(t, state)
+}
+
+func TestStateStore_IndexConsistency(t *testing.T) {
+	state := testStateStore(t)
+	node := testNode()
+	job := testJob()
+	eval := testEval()
+	eval.JobID = job.ID
+	alloc := testAlloc(job, node.ID)
+
+	if err := state.UpsertNode(1000, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertJob(1001, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertEvals(1002, []*models.Evaluation{eval}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertAllocs(1003, []*models.Allocation{alloc}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.DeleteEval(1004, []string{eval.ID}, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	assertIndexConsistent(t, state)
+
+	// Corrupt the store by dropping the jobs index
+	if err := state.RemoveIndex("jobs"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err := state.IndexConsistency()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []IndexMismatch{{Table: "jobs", Index: 0, MaxModifyIndex: 1003}}
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_EvalsByPriorityDesc(t *testing.T) {
+	state := testStateStore(t)
+
+	low := testEval()
+	low.Priority = 10
+	high := testEval()
+	high.Priority = 90
+	midOld := testEval()
+	midOld.Priority = 50
+	midNew := testEval()
+	midNew.Priority = 50
+	blocked := testEval()
+	blocked.Priority = 100
+	blocked.Status = models.EvalStatusBlocked
+
+	if err := state.UpsertEvals(1000, []*models.Evaluation{low, midOld, blocked}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertEvals(1001, []*models.Evaluation{midNew, high}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.EvalsByPriorityDesc(ws, models.EvalStatusPending)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := []string{high.ID, midOld.ID, midNew.ID, low.ID}
+	if len(out) != len(expected) {
+		t.Fatalf("bad: %#v", out)
+	}
+	for i, id := range expected {
+		if out[i].ID != id {
+			t.Fatalf("bad order at %d: got priority %d index %d", i, out[i].Priority, out[i].CreateIndex)
+		}
+	}
+}
+
+func TestStateStore_DuplicateRunningAllocs(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+
+	src1 := testAlloc(job, models.GenerateUUID())
+	src2 := testAlloc(job, models.GenerateUUID())
+	dest := testAlloc(job, models.GenerateUUID())
+	dest.Task = models.TaskTypeDest
+	stopped := testAlloc(job, models.GenerateUUID())
+	stopped.Task = models.TaskTypeDest
+	stopped.DesiredStatus = models.AllocDesiredStatusStop
+
+	allocs := []*models.Allocation{src1, src2, dest, stopped}
+	if err := state.UpsertAllocs(1000, allocs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var updates []*models.Allocation
+	for _, alloc := range allocs {
+		update := alloc.Copy()
+		update.ClientStatus = models.AllocClientStatusRunning
+		updates = append(updates, update)
+	}
+	if err := state.UpdateAllocsFromClient(1001, updates); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.DuplicateRunningAllocs(ws)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 1 {
+		t.Fatalf("bad: %#v", out)
+	}
+	ids := out[job.ID+"/"+models.TaskTypeSrc]
+	if len(ids) != 2 {
+		t.Fatalf("bad: %#v", out)
+	}
+	for _, id := range ids {
+		if id != src1.ID && id != src2.ID {
+			t.Fatalf("unexpected alloc %s", id)
+		}
+	}
+}
+
+func TestIterateTable(t *testing.T) {
+	state := testStateStore(t)
+	job1 := testJob()
+	job2 := testJob()
+	if err := state.UpsertJob(1000, job1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertJob(1001, job2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	alloc := testAlloc(job1, models.GenerateUUID())
+	if err := state.UpsertAllocs(1002, []*models.Allocation{alloc}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	txn := state.db.Txn(false)
+
+	jobs := make(map[string]bool)
+	err := IterateTable(txn, "jobs", "id", func(job *models.Job) error {
+		jobs[job.ID] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(jobs) != 2 || !jobs[job1.ID] || !jobs[job2.ID] {
+		t.Fatalf("bad: %#v", jobs)
+	}
+
+	var allocs []*models.Allocation
+	err = IterateTable(txn, "allocs", "id", func(alloc *models.Allocation) error {
+		allocs = append(allocs, alloc)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(allocs) != 1 || allocs[0].ID != alloc.ID {
+		t.Fatalf("bad: %#v", allocs)
+	}
+
+	// Mismatched types and callback errors are surfaced
+	err = IterateTable(txn, "jobs", "id", func(*models.Node) error { return nil })
+	if err == nil {
+		t.Fatalf("expected type error")
+	}
+	calls := 0
+	err = IterateTable(txn, "jobs", "id", func(*models.Job) error {
+		calls++
+		return fmt.Errorf("stop")
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("bad: %v %d", err, calls)
+	}
+
+	latest, err := state.LatestIndex()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if latest != 1002 {
+		t.Fatalf("bad: %d", latest)
+	}
+}
+
+func TestStateStore_AllocCountByJob(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	if err := state.UpsertJob(1000, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// An allocation left over from a previous incarnation of the job
+	oldJob := job.Copy()
+	oldJob.CreateIndex = 10
+	old := testAlloc(oldJob, models.GenerateUUID())
+	current1 := testAlloc(job, models.GenerateUUID())
+	current2 := testAlloc(job, models.GenerateUUID())
+	stripped := testAlloc(job, models.GenerateUUID())
+	stripped.Job = nil
+	if err := state.UpsertAllocs(1001, []*models.Allocation{old, current1, current2, stripped}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	for _, all := range []bool{true, false} {
+		allocs, err := state.AllocsByJob(ws, job.ID, all)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		count, err := state.AllocCountByJob(job.ID, all)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if count != len(allocs) {
+			t.Fatalf("all=%v: count %d != %d", all, count, len(allocs))
+		}
+	}
+
+	count, err := state.AllocCountByJob(job.ID, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("bad: %d", count)
+	}
+}
+
+func TestStateStore_PauseAllJobs(t *testing.T) {
+	state := testStateStore(t)
+
+	running := testJob()
+	pending := testJob()
+	dead := testJob()
+	for i, job := range []*models.Job{running, pending, dead} {
+		if err := state.UpsertJob(uint64(1000+i), job); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := state.UpdateJobStatus(1003, dead.ID, models.JobStatusDead); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	alloc := testAlloc(running, models.GenerateUUID())
+	stopped := testAlloc(running, models.GenerateUUID())
+	stopped.DesiredStatus = models.AllocDesiredStatusStop
+	if err := state.UpsertAllocs(1004, []*models.Allocation{alloc, stopped}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	paused, err := state.PauseAllJobs(1005)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if paused != 2 {
+		t.Fatalf("bad: %d", paused)
+	}
+
+	ws := memdb.NewWatchSet()
+	for _, job := range []*models.Job{running, pending} {
+		out, err := state.JobByID(ws, job.ID)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out.Status != models.JobStatusPause || out.ModifyIndex != 1005 {
+			t.Fatalf("bad: %#v", out)
+		}
+
+		// The scheduler only pauses allocs of a job whose spec index moved
+		if out.JobModifyIndex != 1005 {
+			t.Fatalf("bad job modify index: %d", out.JobModifyIndex)
+		}
+	}
+	out, err := state.JobByID(ws, dead.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Status != models.JobStatusDead {
+		t.Fatalf("dead job was paused: %#v", out)
+	}
+
+	outAlloc, err := state.AllocByID(ws, alloc.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if outAlloc.DesiredStatus != models.AllocDesiredStatusPause {
+		t.Fatalf("bad: %#v", outAlloc)
+	}
+	outAlloc, err = state.AllocByID(ws, stopped.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if outAlloc.DesiredStatus != models.AllocDesiredStatusStop {
+		t.Fatalf("terminal alloc was paused: %#v", outAlloc)
+	}
+
+	// Pausing again is a no-op
+	paused, err = state.PauseAllJobs(1006)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if paused != 0 {
+		t.Fatalf("bad: %d", paused)
+	}
+	assertIndexConsistent(t, state)
+}
+
+func TestStateStore_ResumeAllJobs(t *testing.T) {
+	state := testStateStore(t)
+
+	running := testJob()
+	pending := testJob()
+	userPaused := testJob()
+	repaused := testJob()
+	for i, job := range []*models.Job{running, pending, userPaused, repaused} {
+		if err := state.UpsertJob(uint64(990+i), job); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := state.UpdateJobStatus(1003, userPaused.ID, models.JobStatusPause); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A user pause that happens to carry the maintenance description
+	lookalike := testJob()
+	lookalike.Status = models.JobStatusPause
+	lookalike.StatusDescription = maintenancePauseDesc
+	lookalike.CreateIndex, lookalike.ModifyIndex = 1003, 1003
+	restore, err := state.Restore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := restore.JobRestore(lookalike); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	restore.Commit()
+
+	// One job has a live allocation, the other only a pending evaluation
+	alloc := testAlloc(running, models.GenerateUUID())
+	userAlloc := testAlloc(running, models.GenerateUUID())
+	userAlloc.DesiredStatus = models.AllocDesiredStatusPause
+	userAlloc.DesiredDescription = maintenancePauseDesc
+	if err := state.UpsertAllocs(1004, []*models.Allocation{alloc, userAlloc}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	eval := testEval()
+	eval.JobID = pending.ID
+	if err := state.UpsertEvals(1005, []*models.Evaluation{eval}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := state.PauseAllJobs(1006); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A user pausing a job during maintenance takes it over
+	if err := state.UpdateJobStatus(1007, repaused.ID, models.JobStatusPause); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	resumed, err := state.ResumeAllJobs(1008)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resumed != 2 {
+		t.Fatalf("bad: %d", resumed)
+	}
+
+	ws := memdb.NewWatchSet()
+	expected := map[string]string{
+		running.ID:    models.JobStatusRunning,
+		pending.ID:    models.JobStatusPending,
+		userPaused.ID: models.JobStatusPause,
+		repaused.ID:   models.JobStatusPause,
+		lookalike.ID:  models.JobStatusPause,
+	}
+	for id, status := range expected {
+		out, err := state.JobByID(ws, id)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out.Status != status {
+			t.Fatalf("job %s: got status %q, want %q", id, out.Status, status)
+		}
+		if out.MaintenancePaused {
+			t.Fatalf("job %s still flagged", id)
+		}
+	}
+
+	// The scheduler only resumes allocs of a job whose spec index moved
+	for _, id := range []string{running.ID, pending.ID} {
+		out, err := state.JobByID(ws, id)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out.JobModifyIndex != 1008 {
+			t.Fatalf("job %s: bad job modify index %d", id, out.JobModifyIndex)
+		}
+	}
+
+	outAlloc, err := state.AllocByID(ws, alloc.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if outAlloc.DesiredStatus != models.AllocDesiredStatusRun || outAlloc.MaintenancePaused {
+		t.Fatalf("bad: %#v", outAlloc)
+	}
+	outAlloc, err = state.AllocByID(ws, userAlloc.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if outAlloc.DesiredStatus != models.AllocDesiredStatusPause {
+		t.Fatalf("user paused alloc was resumed: %#v", outAlloc)
+	}
+	assertIndexConsistent(t, state)
+}
+
+func TestStateStore_JobsWithoutAllocs(t *testing.T) {
+	state := testStateStore(t)
+
+	withAlloc := testJob()
+	without := testJob()
+	stale := testJob()
+	dead := testJob()
+	for i, job := range []*models.Job{withAlloc, without, stale, dead} {
+		if err := state.UpsertJob(uint64(1000+i), job); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := state.UpdateJobStatus(1004, dead.ID, models.JobStatusDead); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The stale job only has an allocation from a previous incarnation
+	oldJob := stale.Copy()
+	oldJob.CreateIndex = 10
+	allocs := []*models.Allocation{
+		testAlloc(withAlloc, models.GenerateUUID()),
+		testAlloc(oldJob, models.GenerateUUID()),
+	}
+	if err := state.UpsertAllocs(1005, allocs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.JobsWithoutAllocs(ws)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	found := make(map[string]bool)
+	for _, job := range out {
+		found[job.ID] = true
+	}
+	if len(found) != 2 || !found[without.ID] || !found[stale.ID] {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_RestoreTable(t *testing.T) {
+	state := testStateStore(t)
+	node := testNode()
+	job := testJob()
+	alloc := testAlloc(job, node.ID)
+	if err := state.UpsertNode(1000, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertJob(1001, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertAllocs(1002, []*models.Allocation{alloc}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Wrong types and unknown tables are rejected
+	if err := state.RestoreTable("jobs", []interface{}{node}); err == nil {
+		t.Fatalf("expected type error")
+	}
+	if err := state.RestoreTable("bogus", nil); err == nil {
+		t.Fatalf("expected unknown table error")
+	}
+
+	good1 := testJob()
+	good1.CreateIndex, good1.ModifyIndex = 900, 900
+	good2 := testJob()
+	good2.CreateIndex, good2.ModifyIndex = 950, 1500
+	if err := state.RestoreTable("jobs", []interface{}{good1, good2}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	iter, err := state.Jobs(ws)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	found := make(map[string]bool)
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		found[raw.(*models.Job).ID] = true
+	}
+	if len(found) != 2 || !found[good1.ID] || !found[good2.ID] {
+		t.Fatalf("bad: %#v", found)
+	}
+
+	// Other tables are untouched
+	if out, _ := state.NodeByID(ws, node.ID); out == nil || out.ModifyIndex != 1000 {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out, _ := state.AllocByID(ws, alloc.ID); out == nil || out.ModifyIndex != 1002 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	index, err := state.Index("jobs")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if index != 1500 {
+		t.Fatalf("bad index: %d", index)
+	}
+	assertIndexConsistent(t, state)
+}
+
+func TestStateStore_AllocsByClientStatusModifiedSince(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+
+	oldFailure := testAlloc(job, models.GenerateUUID())
+	newFailure := testAlloc(job, models.GenerateUUID())
+	running := testAlloc(job, models.GenerateUUID())
+	if err := state.UpsertAllocs(1000, []*models.Allocation{oldFailure, newFailure, running}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	update := oldFailure.Copy()
+	update.ClientStatus = models.AllocClientStatusFailed
+	if err := state.UpdateAllocsFromClient(1001, []*models.Allocation{update}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	update = newFailure.Copy()
+	update.ClientStatus = models.AllocClientStatusFailed
+	runningUpdate := running.Copy()
+	runningUpdate.ClientStatus = models.AllocClientStatusRunning
+	if err := state.UpdateAllocsFromClient(1005, []*models.Allocation{update, runningUpdate}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.AllocsByClientStatusModifiedSince(ws, models.AllocClientStatusFailed, 1002)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 1 || out[0].ID != newFailure.ID {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	out, err = state.AllocsByClientStatusModifiedSince(ws, models.AllocClientStatusFailed, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_NodesFailingHeartbeat(t *testing.T) {
+	state := testStateStore(t)
+	// StatusUpdatedAt has second precision
+	now := time.Now().Truncate(time.Second)
+
+	fresh := testNode()
+	fresh.StatusUpdatedAt = now.Add(-5 * time.Second).Unix()
+	stale := testNode()
+	stale.StatusUpdatedAt = now.Add(-time.Minute).Unix()
+	down := testNode()
+	down.Status = models.NodeStatusDown
+	down.StatusUpdatedAt = now.Add(-time.Hour).Unix()
+
+	for i, node := range []*models.Node{fresh, stale, down} {
+		if err := state.UpsertNode(uint64(1000+i), node); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.NodesFailingHeartbeat(ws, 30*time.Second, now)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 1 || out[0].ID != stale.ID {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// A heartbeat keeps the stale node fresh
+	if err := state.UpdateNodeHeartbeat(1003, stale.ID, now); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	later := now.Add(30 * time.Second)
+	out, err = state.NodesFailingHeartbeat(nil, 30*time.Second, later)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 1 || out[0].ID != fresh.ID {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// So does a heartbeat that goes through a status update
+	if err := state.UpdateNodeStatus(1004, fresh.ID, models.NodeStatusReady, later.Unix()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err = state.NodesFailingHeartbeat(nil, 30*time.Second, later)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// A zero timestamp leaves the last heartbeat alone
+	if err := state.UpdateNodeStatus(1005, fresh.ID, models.NodeStatusReady, 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	node, err := state.NodeByID(nil, fresh.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if node.StatusUpdatedAt != later.Unix() {
+		t.Fatalf("bad: %d", node.StatusUpdatedAt)
+	}
+}
+
+func TestStateStore_UpdateNodeHeartbeat(t *testing.T) {
+	state := testStateStore(t)
+	node := testNode()
+	node.StatusUpdatedAt = time.Now().Add(-time.Minute).Unix()
+	if err := state.UpsertNode(1000, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := state.UpdateNodeHeartbeat(1001, models.GenerateUUID(), time.Now()); err == nil {
+		t.Fatalf("expected error for missing node")
+	}
+
+	ws := memdb.NewWatchSet()
+	before, err := state.NodeByID(ws, node.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ts := time.Now()
+	if err := state.UpdateNodeHeartbeat(1002, node.ID, ts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	out, err := state.NodeByID(memdb.NewWatchSet(), node.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.StatusUpdatedAt != ts.Unix() || out.ModifyIndex != 1002 {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out.Status != models.NodeStatusReady {
+		t.Fatalf("status changed: %v", out.Status)
+	}
+
+	// The previously returned node is unchanged
+	if before.StatusUpdatedAt == ts.Unix() || before.ModifyIndex != 1000 {
+		t.Fatalf("stored node modified in place: %#v", before)
+	}
+}
+
+func TestStateStore_EvalsReady(t *testing.T) {
+	state := testStateStore(t)
+	now := time.Now()
+
+	ready := testEval()
+	past := testEval()
+	past.WaitUntil = now.Add(-time.Minute)
+	future := testEval()
+	future.WaitUntil = now.Add(time.Minute)
+	blocked := testEval()
+	blocked.Status = models.EvalStatusBlocked
+
+	if err := state.UpsertEvals(1000, []*models.Evaluation{ready, past, future, blocked}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.EvalsReady(ws, now)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	found := make(map[string]bool)
+	for _, eval := range out {
+		found[eval.ID] = true
+	}
+	if len(found) != 2 || !found[ready.ID] || !found[past.ID] {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Once the wait passes the eval becomes ready
+	out, err = state.EvalsReady(ws, now.Add(2*time.Minute))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 3 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_PartialSnapshot(t *testing.T) {
+	state := testStateStore(t)
+	node := testNode()
+	job := testJob()
+	alloc := testAlloc(job, node.ID)
+	if err := state.UpsertNode(1000, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertJob(1001, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertAllocs(1002, []*models.Allocation{alloc}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := state.PartialSnapshot([]string{"bogus"}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	snap, err := state.PartialSnapshot([]string{"jobs"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Later writes are not visible in the snapshot
+	if err := state.UpsertJob(1003, testJob()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	jobs, err := snap.Jobs(ws)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	count := 0
+	for raw := jobs.Next(); raw != nil; raw = jobs.Next() {
+		if raw.(*models.Job).ID != job.ID {
+			t.Fatalf("unexpected job: %#v", raw)
+		}
+		count++
+	}
+	if count != 1 {
+		t.Fatalf("bad job count: %d", count)
+	}
+
+	allocs, err := snap.Allocs(ws)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if raw := allocs.Next(); raw != nil {
+		t.Fatalf("allocs should be empty: %#v", raw)
+	}
+	nodes, err := snap.Nodes(ws)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if raw := nodes.Next(); raw != nil {
+		t.Fatalf("nodes should be empty: %#v", raw)
+	}
+
+	index, err := snap.Index("jobs")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if index != 1002 {
+		t.Fatalf("bad index: %d", index)
+	}
+	if index, _ := snap.Index("allocs"); index != 0 {
+		t.Fatalf("bad allocs index: %d", index)
+	}
+}
+
+func TestStateStore_DeleteEvalsByJob(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	if err := state.UpsertJob(1000, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var evals []*models.Evaluation
+	for i := 0; i < 3; i++ {
+		eval := testEval()
+		eval.JobID = job.ID
+		evals = append(evals, eval)
+	}
+	other := testEval()
+	evals = append(evals, other)
+	if err := state.UpsertEvals(1001, evals); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.JobByID(ws, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Status != models.JobStatusPending {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	deleted, err := state.DeleteEvalsByJob(1002, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if deleted != 3 {
+		t.Fatalf("bad: %d", deleted)
+	}
+
+	remaining, err := state.EvalsByJob(ws, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(remaining) != 0 {
+		t.Fatalf("bad: %#v", remaining)
+	}
+	if e, _ := state.EvalByID(ws, other.ID); e == nil {
+		t.Fatalf("unrelated eval was deleted")
+	}
+
+	// With no evals or allocs left the job is considered finished
+	out, err = state.JobByID(ws, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Status != models.JobStatusComplete || out.ModifyIndex != 1002 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	if index, _ := state.Index("evals"); index != 1002 {
+		t.Fatalf("bad index: %d", index)
+	}
+
+	// Nothing left to delete
+	if deleted, err := state.DeleteEvalsByJob(1003, job.ID); err != nil || deleted != 0 {
+		t.Fatalf("bad: %d %v", deleted, err)
+	}
+	assertIndexConsistent(t, state)
+}
+
+func TestStateSnapshot_ExportJSON(t *testing.T) {
+	state := testStateStore(t)
+	node := testNode()
+	job := testJob()
+	alloc := testAlloc(job, node.ID)
+	eval := testEval()
+	eval.JobID = job.ID
+	if err := state.UpsertNode(1000, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertJob(1001, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertEvals(1002, []*models.Evaluation{eval}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertAllocs(1003, []*models.Allocation{alloc}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	snap, err := state.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := snap.ExportJSON(&buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var out map[string][]json.RawMessage
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := map[string]int{
+		"index":  4,
+		"nodes":  1,
+		"jobs":   1,
+		"orders": 0,
+		"evals":  1,
+		"allocs": 1,
+
+		"alloc_stats": 0,
+	}
+	if len(out) != len(expected) {
+		t.Fatalf("bad keys: %v", out)
+	}
+	for table, count := range expected {
+		rows, ok := out[table]
+		if !ok {
+			t.Fatalf("missing table %q", table)
+		}
+		if rows == nil || len(rows) != count {
+			t.Fatalf("bad %s count: %d", table, len(rows))
+		}
+	}
+
+	var jobOut models.Job
+	if err := json.Unmarshal(out["jobs"][0], &jobOut); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if jobOut.ID != job.ID {
+		t.Fatalf("bad: %#v", jobOut)
+	}
+}
+
+func TestStateStore_ImportJSON(t *testing.T) {
+	src := testStateStore(t)
+	node := testNode()
+	job := testJob()
+	eval := testEval()
+	eval.JobID = job.ID
+	alloc := testAlloc(job, node.ID)
+	other := testJob()
+	otherEval := testEval()
+	otherEval.JobID = other.ID
+	if err := src.UpsertNode(1000, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := src.UpsertJob(1001, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := src.UpsertJob(1002, other); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := src.UpsertEvals(1003, []*models.Evaluation{eval, otherEval}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := src.UpsertAllocs(1004, []*models.Allocation{alloc}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stats := &models.AllocStats{AllocID: alloc.ID, Stats: &models.AllocStatistics{}}
+	if err := src.UpsertAllocStats(1005, stats); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	snap, err := src.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := snap.ExportJSON(&buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Tamper with a status in the fixture; it must be recomputed on import
+	var fixture map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &fixture); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, raw := range fixture["jobs"].([]interface{}) {
+		raw.(map[string]interface{})["Status"] = models.JobStatusComplete
+	}
+	data, err := json.Marshal(fixture)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := testStateStore(t).ImportJSON(2000, bytes.NewReader([]byte("{"))); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	dst := testStateStore(t)
+	if err := dst.ImportJSON(2000, bytes.NewReader(data)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	if out, _ := dst.NodeByID(ws, node.ID); out == nil {
+		t.Fatalf("missing node")
+	}
+	if out, _ := dst.EvalByID(ws, eval.ID); out == nil || out.ModifyIndex != 2000 {
+		t.Fatalf("bad eval: %#v", out)
+	}
+	if out, _ := dst.AllocByID(ws, alloc.ID); out == nil || out.CreateIndex != 2000 {
+		t.Fatalf("bad alloc: %#v", out)
+	}
+	if out, _ := dst.AllocStatsByID(ws, alloc.ID); out == nil || out.ModifyIndex != 2000 {
+		t.Fatalf("bad alloc stats: %#v", out)
+	}
+
+	expected := map[string]string{
+		job.ID:   models.JobStatusRunning,
+		other.ID: models.JobStatusPending,
+	}
+	for id, status := range expected {
+		out, err := dst.JobByID(ws, id)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out == nil || out.Status != status {
+			t.Fatalf("bad job %s: %#v", id, out)
+		}
+	}
+	assertIndexConsistent(t, dst)
+}
+
+func TestStateStore_WatchNodeAllocs(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	nodeID := models.GenerateUUID()
+	alloc := testAlloc(job, nodeID)
+	if err := state.UpsertAllocs(1000, []*models.Allocation{alloc}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Already past minIndex, returns right away
+	out, index, err := state.WatchNodeAllocs(context.Background(), nodeID, 999)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 1 || index != 1000 {
+		t.Fatalf("bad: %d %#v", index, out)
+	}
+
+	type result struct {
+		allocs []*models.Allocation
+		index  uint64
+		err    error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		allocs, index, err := state.WatchNodeAllocs(context.Background(), nodeID, 1000)
+		resultCh <- result{allocs, index, err}
+	}()
+
+	// Allocs on other nodes don't unblock the watcher
+	if err := state.UpsertAllocs(1001, []*models.Allocation{testAlloc(job, models.GenerateUUID())}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case res := <-resultCh:
+		t.Fatalf("watcher returned early: %#v", res)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	alloc2 := testAlloc(job, nodeID)
+	if err := state.UpsertAllocs(1002, []*models.Allocation{alloc2}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case res := <-resultCh:
+		if res.err != nil {
+			t.Fatalf("err: %v", res.err)
+		}
+		if len(res.allocs) != 2 || res.index != 1002 {
+			t.Fatalf("bad: %d %#v", res.index, res.allocs)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("watcher did not unblock")
+	}
+
+	// A cancelled context ends the wait
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := state.WatchNodeAllocs(ctx, nodeID, 1002); err != context.DeadlineExceeded {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestStateStore_GarbageCollect(t *testing.T) {
+	state := testStateStore(t)
+
+	// A complete job with a finished eval and a stopped alloc
+	dead := testJob()
+	deadEval := testEval()
+	deadEval.JobID = dead.ID
+	deadEval.Status = models.EvalStatusComplete
+	deadAlloc := testAlloc(dead, models.GenerateUUID())
+	deadAlloc.DesiredStatus = models.AllocDesiredStatusStop
+	if err := state.UpsertJob(1000, dead); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertEvals(1001, []*models.Evaluation{deadEval}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertAllocs(1002, []*models.Allocation{deadAlloc}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A job marked dead that still has a running alloc
+	busy := testJob()
+	busyAlloc := testAlloc(busy, models.GenerateUUID())
+	if err := state.UpsertJob(1003, busy); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertAllocs(1004, []*models.Allocation{busyAlloc}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpdateJobStatus(1005, busy.ID, models.JobStatusDead); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A pending job and an alloc whose job is gone
+	live := testJob()
+	liveEval := testEval()
+	liveEval.JobID = live.ID
+	orphan := testAlloc(testJob(), models.GenerateUUID())
+	if err := state.UpsertJob(1006, live); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertEvals(1007, []*models.Evaluation{liveEval}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertAllocs(1008, []*models.Allocation{orphan}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A complete job newer than the threshold
+	recent := testJob()
+	if err := state.UpsertJob(1020, recent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpdateJobStatus(1021, recent.ID, models.JobStatusComplete); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	stats, err := state.GarbageCollect(1030, 1010)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := &GCStats{Jobs: 1, Evals: 1, Allocs: 1, OrphanedAllocs: 1}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("bad: %#v", stats)
+	}
+
+	ws := memdb.NewWatchSet()
+	if out, _ := state.JobByID(ws, dead.ID); out != nil {
+		t.Fatalf("dead job not collected")
+	}
+	if out, _ := state.EvalByID(ws, deadEval.ID); out != nil {
+		t.Fatalf("dead eval not collected")
+	}
+	if out, _ := state.AllocByID(ws, deadAlloc.ID); out != nil {
+		t.Fatalf("dead alloc not collected")
+	}
+	if out, _ := state.AllocByID(ws, orphan.ID); out != nil {
+		t.Fatalf("orphaned alloc not collected")
+	}
+	for _, id := range []string{busy.ID, live.ID, recent.ID} {
+		if out, _ := state.JobByID(ws, id); out == nil {
+			t.Fatalf("job %s was collected", id)
+		}
+	}
+	if out, _ := state.AllocByID(ws, busyAlloc.ID); out == nil {
+		t.Fatalf("running alloc was collected")
+	}
+	if out, _ := state.EvalByID(ws, liveEval.ID); out == nil {
+		t.Fatalf("pending eval was collected")
+	}
+
+	for _, table := range []string{"jobs", "evals", "allocs"} {
+		if index, _ := state.Index(table); index != 1030 {
+			t.Fatalf("bad %s index: %d", table, index)
+		}
+	}
+
+	// A second pass has nothing left to do
+	stats, err = state.GarbageCollect(1031, 1010)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(stats, &GCStats{}) {
+		t.Fatalf("bad: %#v", stats)
+	}
+	if index, _ := state.Index("jobs"); index != 1030 {
+		t.Fatalf("bad index: %d", index)
+	}
+}
+
+func TestStateStore_JobsByMeta(t *testing.T) {
+	state := testStateStore(t)
+	east := testJob()
+	east.Meta = map[string]string{"source": "east", "owner": "dba"}
+	west := testJob()
+	west.Meta = map[string]string{"source": "west"}
+	bare := testJob()
+	for i, job := range []*models.Job{east, west, bare} {
+		if err := state.UpsertJob(uint64(1000+i), job); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.JobsByMeta(ws, "source", "east")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 1 || out[0].ID != east.ID {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// An empty value matches any job carrying the key
+	out, err = state.JobsByMeta(ws, "source", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ids := make(map[string]bool)
+	for _, job := range out {
+		ids[job.ID] = true
+	}
+	if len(ids) != 2 || !ids[east.ID] || !ids[west.ID] {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// A key must not match on a prefix of another key
+	out, err = state.JobsByMeta(ws, "own", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Changing the metadata fires the watch and moves the job
+	update := west.Copy()
+	update.Meta["source"] = "east"
+	if err := state.UpsertJob(1010, update); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	out, err = state.JobsByMeta(memdb.NewWatchSet(), "source", "east")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_RecentEvals(t *testing.T) {
+	state := testStateStore(t)
+
+	var evals []*models.Evaluation
+	for i := 0; i < 5; i++ {
+		eval := testEval()
+		evals = append(evals, eval)
+		if err := state.UpsertEvals(uint64(1000+i), []*models.Evaluation{eval}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.RecentEvals(ws, 3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 3 {
+		t.Fatalf("bad: %#v", out)
+	}
+	for i, eval := range out {
+		if eval.ID != evals[4-i].ID {
+			t.Fatalf("bad %d: %#v", i, eval)
+		}
+	}
+
+	out, err = state.RecentEvals(ws, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 5 || out[4].ID != evals[0].ID {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	if err := state.UpsertEvals(1010, []*models.Evaluation{testEval()}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+}
+
+func TestStateStore_BatchIndexWrites(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	if err := state.UpsertJob(1000, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var evals []*models.Evaluation
+	var allocs []*models.Allocation
+	for i := 0; i < 200; i++ {
+		eval := testEval()
+		eval.JobID = job.ID
+		evals = append(evals, eval)
+		allocs = append(allocs, testAlloc(job, models.GenerateUUID()))
+	}
+	if err := state.UpsertEvals(1001, evals); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertAllocs(1002, allocs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var updates []*models.Allocation
+	for _, alloc := range allocs {
+		update := alloc.Copy()
+		update.ClientStatus = models.AllocClientStatusRunning
+		updates = append(updates, update)
+	}
+	if err := state.UpdateAllocsFromClient(1003, updates); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := map[string]uint64{"evals": 1001, "allocs": 1003}
+	for table, want := range expected {
+		index, err := state.Index(table)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if index != want {
+			t.Fatalf("bad %s index: %d", table, index)
+		}
+	}
+
+	// An empty batch leaves the index alone
+	if err := state.UpsertEvals(1004, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if index, _ := state.Index("evals"); index != 1001 {
+		t.Fatalf("bad index: %d", index)
+	}
+	assertIndexConsistent(t, state)
+}
+
+func TestStateStore_StaleAllocsForJob(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	if err := state.UpsertJob(1000, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// An alloc left over from an earlier registration of the job
+	previous := job.Copy()
+	previous.CreateIndex = 900
+	stale := testAlloc(previous, models.GenerateUUID())
+	current := testAlloc(job, models.GenerateUUID())
+	bare := testAlloc(job, models.GenerateUUID())
+	bare.Job = nil
+	if err := state.UpsertAllocs(1001, []*models.Allocation{stale, current, bare}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.StaleAllocsForJob(ws, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 1 || out[0].ID != stale.ID {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	older := testAlloc(previous, models.GenerateUUID())
+	if err := state.UpsertAllocs(1002, []*models.Allocation{older}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	out, err = state.StaleAllocsForJob(memdb.NewWatchSet(), job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	out, err = state.StaleAllocsForJob(memdb.NewWatchSet(), "missing")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_FollowupEvalForAlloc(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	eval := testEval()
+	eval.JobID = job.ID
+	failed := testAlloc(job, models.GenerateUUID())
+	failed.ClientStatus = models.AllocClientStatusFailed
+	failed.FollowupEvalID = eval.ID
+	healthy := testAlloc(job, models.GenerateUUID())
+	if err := state.UpsertAllocs(1000, []*models.Allocation{failed, healthy}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The follow-up eval hasn't been written yet
+	ws := memdb.NewWatchSet()
+	out, err := state.FollowupEvalForAlloc(ws, failed.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != nil {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	if err := state.UpsertEvals(1001, []*models.Evaluation{eval}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	out, err = state.FollowupEvalForAlloc(memdb.NewWatchSet(), failed.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out == nil || out.ID != eval.ID {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	for _, id := range []string{healthy.ID, models.GenerateUUID()} {
+		out, err := state.FollowupEvalForAlloc(memdb.NewWatchSet(), id)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out != nil {
+			t.Fatalf("bad: %#v", out)
+		}
+	}
+}
+
+func TestStateStore_UpdateNodesStatus(t *testing.T) {
+	state := testStateStore(t)
+	node1 := testNode()
+	node2 := testNode()
+	if err := state.UpsertNode(1000, node1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertNode(1001, node2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	missing := models.GenerateUUID()
+	updatedAt := time.Now().Unix()
+	err := state.UpdateNodesStatus(1002, []string{node1.ID, missing, node2.ID}, models.NodeStatusDown, updatedAt)
+	nerr, ok := err.(*NodesNotFoundError)
+	if !ok {
+		t.Fatalf("bad: %v", err)
+	}
+	if !reflect.DeepEqual(nerr.NodeIDs, []string{missing}) {
+		t.Fatalf("bad: %#v", nerr.NodeIDs)
+	}
+
+	ws := memdb.NewWatchSet()
+	for _, id := range []string{node1.ID, node2.ID} {
+		out, err := state.NodeByID(ws, id)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out.Status != models.NodeStatusDown || out.ModifyIndex != 1002 || out.StatusUpdatedAt != updatedAt {
+			t.Fatalf("bad: %#v", out)
+		}
+	}
+	if index, _ := state.Index("nodes"); index != 1002 {
+		t.Fatalf("bad index: %d", index)
+	}
+
+	// The batch shows up as one mutation per node, all at the same index
+	var entries []AuditEntry
+	for _, entry := range state.RecentMutations(0) {
+		if entry.Method == "UpdateNodesStatus" {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) != 2 || entries[0].Index != 1002 || entries[1].Index != 1002 {
+		t.Fatalf("bad: %#v", entries)
+	}
+
+	// Nothing to update leaves the index alone
+	if err := state.UpdateNodesStatus(1003, []string{missing}, models.NodeStatusReady, 0); err == nil {
+		t.Fatalf("expected error")
+	}
+	if index, _ := state.Index("nodes"); index != 1002 {
+		t.Fatalf("bad index: %d", index)
+	}
+	if err := state.UpdateNodesStatus(1004, nil, models.NodeStatusReady, 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A zero timestamp leaves the last one alone
+	if err := state.UpdateNodesStatus(1005, []string{node1.ID}, models.NodeStatusReady, 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err := state.NodeByID(nil, node1.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Status != models.NodeStatusReady || out.StatusUpdatedAt != updatedAt {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_StuckEvals(t *testing.T) {
+	state := testStateStore(t)
+	oldPending := testEval()
+	oldBlocked := testEval()
+	oldBlocked.Status = models.EvalStatusBlocked
+	oldComplete := testEval()
+	oldComplete.Status = models.EvalStatusComplete
+	if err := state.UpsertEvals(1000, []*models.Evaluation{oldPending, oldBlocked, oldComplete}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fresh := testEval()
+	if err := state.UpsertEvals(1010, []*models.Evaluation{fresh}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.StuckEvals(ws, 1005)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ids := make(map[string]bool)
+	for _, eval := range out {
+		ids[eval.ID] = true
+	}
+	if len(ids) != 2 || !ids[oldPending.ID] || !ids[oldBlocked.ID] {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Progress on an eval takes it off the list
+	update := oldPending.Copy()
+	update.Status = models.EvalStatusComplete
+	if err := state.UpsertEvals(1011, []*models.Evaluation{update}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	out, err = state.StuckEvals(memdb.NewWatchSet(), 1005)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 1 || out[0].ID != oldBlocked.ID {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_JobForAlloc(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	if err := state.UpsertJob(1000, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The alloc embeds an older copy of the job
+	old := job.Copy()
+	old.Name = "old-name"
+	alloc := testAlloc(old, models.GenerateUUID())
+	orphan := testAlloc(testJob(), models.GenerateUUID())
+	if err := state.UpsertAllocs(1001, []*models.Allocation{alloc, orphan}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.JobForAlloc(ws, alloc.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out == nil || out.ID != job.ID || out.Name != job.Name {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	for _, id := range []string{orphan.ID, models.GenerateUUID()} {
+		out, err := state.JobForAlloc(memdb.NewWatchSet(), id)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out != nil {
+			t.Fatalf("bad: %#v", out)
+		}
+	}
+
+	// Updates to the live job fire the watch
+	if err := state.UpdateJobStatus(1002, job.ID, models.JobStatusPause); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+}
+
+func TestStateStore_UpdateAllocsFromClient_TerminalIsFinal(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	if err := state.UpsertJob(1000, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	done := testAlloc(job, models.GenerateUUID())
+	starting := testAlloc(job, models.GenerateUUID())
+	if err := state.UpsertAllocs(1001, []*models.Allocation{done, starting}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	complete := done.Copy()
+	complete.ClientStatus = models.AllocClientStatusComplete
+	if err := state.UpdateAllocsFromClient(1002, []*models.Allocation{complete}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A delayed running update for the complete alloc arrives with a
+	// legitimate pending->running update for the other one
+	stale := done.Copy()
+	stale.ClientStatus = models.AllocClientStatusRunning
+	running := starting.Copy()
+	running.ClientStatus = models.AllocClientStatusRunning
+	if err := state.UpdateAllocsFromClient(1003, []*models.Allocation{stale, running}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.AllocByID(ws, done.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.ClientStatus != models.AllocClientStatusComplete || out.ModifyIndex != 1002 {
+		t.Fatalf("bad: %#v", out)
+	}
+	out, err = state.AllocByID(ws, starting.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.ClientStatus != models.AllocClientStatusRunning || out.ModifyIndex != 1003 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Moving between terminal statuses is still allowed
+	failed := done.Copy()
+	failed.ClientStatus = models.AllocClientStatusFailed
+	if err := state.UpdateAllocsFromClient(1004, []*models.Allocation{failed}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err = state.AllocByID(ws, done.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.ClientStatus != models.AllocClientStatusFailed {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_NodesByClass(t *testing.T) {
+	state := testStateStore(t)
+	extract := testNode()
+	extract.NodeClass = "extract"
+	apply1 := testNode()
+	apply1.NodeClass = "apply"
+	apply2 := testNode()
+	apply2.NodeClass = "apply"
+	unclassed := testNode()
+	for i, node := range []*models.Node{extract, apply1, apply2, unclassed} {
+		if err := state.UpsertNode(uint64(1000+i), node); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	nodesByClass := func(ws memdb.WatchSet, class string) map[string]bool {
+		iter, err := state.NodesByClass(ws, class)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		out := make(map[string]bool)
+		for raw := iter.Next(); raw != nil; raw = iter.Next() {
+			out[raw.(*models.Node).ID] = true
+		}
+		return out
+	}
+
+	ws := memdb.NewWatchSet()
+	if out := nodesByClass(ws, "apply"); len(out) != 2 || !out[apply1.ID] || !out[apply2.ID] {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out := nodesByClass(ws, "extract"); len(out) != 1 || !out[extract.ID] {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out := nodesByClass(ws, "app"); len(out) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Re-registering with a new class moves the node
+	moved := new(models.Node)
+	*moved = *apply2
+	moved.NodeClass = "extract"
+	if err := state.UpsertNode(1010, moved); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	ws = memdb.NewWatchSet()
+	if out := nodesByClass(ws, "apply"); len(out) != 1 || !out[apply1.ID] {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out := nodesByClass(ws, "extract"); len(out) != 2 || !out[apply2.ID] {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_AllocCountsByNode(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	nodes := []string{models.GenerateUUID(), models.GenerateUUID(), models.GenerateUUID()}
+	var allocs []*models.Allocation
+	for i, nodeID := range nodes {
+		for j := 0; j <= i; j++ {
+			alloc := testAlloc(job, nodeID)
+			if j == 1 {
+				alloc.DesiredStatus = models.AllocDesiredStatusStop
+			}
+			allocs = append(allocs, alloc)
+		}
+	}
+	if err := state.UpsertAllocs(1000, allocs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	counts, err := state.AllocCountsByNode(ws)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(counts) != len(nodes) {
+		t.Fatalf("bad: %#v", counts)
+	}
+	total := 0
+	for _, nodeID := range nodes {
+		out, err := state.AllocsByNode(memdb.NewWatchSet(), nodeID)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if counts[nodeID] != len(out) {
+			t.Fatalf("bad count for %s: %d != %d", nodeID, counts[nodeID], len(out))
+		}
+		total += counts[nodeID]
+	}
+	if total != len(allocs) {
+		t.Fatalf("bad total: %d", total)
+	}
+
+	if err := state.UpsertAllocs(1001, []*models.Allocation{testAlloc(job, nodes[0])}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+}
+
+func TestStateStore_BlockedEvalsByClass(t *testing.T) {
+	state := testStateStore(t)
+	needsApply := testEval()
+	needsApply.Status = models.EvalStatusBlocked
+	needsApply.ClassEligibility = map[string]bool{"apply": true, "extract": false}
+	escaped := testEval()
+	escaped.Status = models.EvalStatusBlocked
+	escaped.EscapedComputedClass = true
+	escaped.ClassEligibility = map[string]bool{"apply": false, "extract": false}
+	pending := testEval()
+	pending.ClassEligibility = map[string]bool{"apply": true}
+	if err := state.UpsertEvals(1000, []*models.Evaluation{needsApply, escaped, pending}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	blockedByClass := func(class string) map[string]bool {
+		out, err := state.BlockedEvalsByClass(memdb.NewWatchSet(), class)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		ids := make(map[string]bool)
+		for _, eval := range out {
+			ids[eval.ID] = true
+		}
+		return ids
+	}
+
+	if out := blockedByClass("apply"); len(out) != 2 || !out[needsApply.ID] || !out[escaped.ID] {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out := blockedByClass("extract"); len(out) != 1 || !out[escaped.ID] {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// A class the eval never saw may have the capacity it needs
+	if out := blockedByClass("new-class"); len(out) != 2 || !out[needsApply.ID] {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_JobsBySchedulerAndStatus(t *testing.T) {
+	state := testStateStore(t)
+
+	// One job per scheduler type and status
+	types := []string{models.JobTypeSync, "batch"}
+	statuses := []string{models.JobStatusPending, models.JobStatusPause, models.JobStatusDead}
+	expected := make(map[string]string)
+	index := uint64(1000)
+	for _, typ := range types {
+		for _, status := range statuses {
+			job := testJob()
+			job.Type = typ
+			if err := state.UpsertJob(index, job); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if err := state.UpdateJobStatus(index+1, job.ID, status); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			index += 2
+			expected[typ+"/"+status] = job.ID
+		}
+	}
+
+	for _, typ := range types {
+		for _, status := range statuses {
+			out, err := state.JobsBySchedulerAndStatus(memdb.NewWatchSet(), typ, status)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if len(out) != 1 || out[0].ID != expected[typ+"/"+status] {
+				t.Fatalf("bad %s/%s: %#v", typ, status, out)
+			}
+		}
+	}
+
+	out, err := state.JobsBySchedulerAndStatus(memdb.NewWatchSet(), "batch", models.JobStatusRunning)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_DeleteStaleAllocsForJob(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	if err := state.UpsertJob(1000, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A running alloc left over from an earlier registration of the job,
+	// and a stopped one from the current registration
+	previous := job.Copy()
+	previous.CreateIndex = 900
+	stale := testAlloc(previous, models.GenerateUUID())
+	stale.ClientStatus = models.AllocClientStatusRunning
+	current := testAlloc(job, models.GenerateUUID())
+	current.DesiredStatus = models.AllocDesiredStatusStop
+	if err := state.UpsertAllocs(1001, []*models.Allocation{stale, current}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.JobByID(ws, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Status != models.JobStatusRunning {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	deleted, err := state.DeleteStaleAllocsForJob(1002, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if deleted != 1 {
+		t.Fatalf("bad: %d", deleted)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	ws = memdb.NewWatchSet()
+	if out, _ := state.AllocByID(ws, stale.ID); out != nil {
+		t.Fatalf("stale alloc not deleted")
+	}
+	if out, _ := state.AllocByID(ws, current.ID); out == nil {
+		t.Fatalf("current alloc deleted")
+	}
+
+	// Only the stopped alloc is left so the job is no longer running
+	out, err = state.JobByID(ws, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Status != models.JobStatusComplete || out.ModifyIndex != 1002 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	if deleted, err := state.DeleteStaleAllocsForJob(1003, job.ID); err != nil || deleted != 0 {
+		t.Fatalf("bad: %d %v", deleted, err)
+	}
+	if index, _ := state.Index("allocs"); index != 1002 {
+		t.Fatalf("bad index: %d", index)
+	}
+	assertIndexConsistent(t, state)
+}
+
+func TestStateStore_AllocsByPreviousDesiredStatus(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	flipped := testAlloc(job, models.GenerateUUID())
+	stable := testAlloc(job, models.GenerateUUID())
+	if err := state.UpsertAllocs(1000, []*models.Allocation{flipped, stable}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	stop := flipped.Copy()
+	stop.DesiredStatus = models.AllocDesiredStatusStop
+	same := stable.Copy()
+	same.DesiredDescription = "no change"
+	if err := state.UpsertAllocs(1001, []*models.Allocation{stop, same}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.AllocByID(ws, flipped.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.PreviousDesiredStatus != models.AllocDesiredStatusRun {
+		t.Fatalf("bad: %#v", out)
+	}
+	out, err = state.AllocByID(ws, stable.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.PreviousDesiredStatus != "" {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	allocs, err := state.AllocsByPreviousDesiredStatus(ws, models.AllocDesiredStatusRun)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(allocs) != 1 || allocs[0].ID != flipped.ID {
+		t.Fatalf("bad: %#v", allocs)
+	}
+
+	// An update that keeps the desired status keeps the recorded value
+	again := stop.Copy()
+	again.PreviousDesiredStatus = ""
+	again.DesiredDescription = "still stopped"
+	if err := state.UpsertAllocs(1002, []*models.Allocation{again}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err = state.AllocByID(ws, flipped.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.PreviousDesiredStatus != models.AllocDesiredStatusRun {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Direct desired status changes are tracked too
+	if err := state.SetAllocDesiredStatus(1003, stable.ID, models.AllocDesiredStatusPause); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	allocs, err = state.AllocsByPreviousDesiredStatus(ws, models.AllocDesiredStatusRun)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(allocs) != 2 {
+		t.Fatalf("bad: %#v", allocs)
+	}
+	allocs, err = state.AllocsByPreviousDesiredStatus(ws, models.AllocDesiredStatusStop)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(allocs) != 0 {
+		t.Fatalf("bad: %#v", allocs)
+	}
+}
+
+func TestStateStore_UpsertEvalsOpts(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	if err := state.UpsertJob(1000, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpdateJobStatus(1001, job.ID, models.JobStatusComplete); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	eval := testEval()
+	eval.JobID = job.ID
+	if err := state.UpsertEvalsOpts(1002, []*models.Evaluation{eval}, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	if out, _ := state.EvalByID(ws, eval.ID); out == nil {
+		t.Fatalf("missing eval")
+	}
+	out, err := state.JobByID(ws, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Status != models.JobStatusComplete || out.ModifyIndex != 1001 {
+		t.Fatalf("bad: %#v", out)
+	}
+	if index, _ := state.Index("evals"); index != 1002 {
+		t.Fatalf("bad index: %d", index)
+	}
+
+	// Recomputing afterwards picks up the pending eval
+	if err := state.UpsertEvalsOpts(1003, []*models.Evaluation{eval}, true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err = state.JobByID(ws, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Status != models.JobStatusPending || out.ModifyIndex != 1003 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_NodeJobSummary(t *testing.T) {
+	state := testStateStore(t)
+	nodeID := models.GenerateUUID()
+	job1 := testJob()
+	job2 := testJob()
+	allocs := []*models.Allocation{
+		testAlloc(job1, nodeID),
+		testAlloc(job1, nodeID),
+		testAlloc(job2, nodeID),
+		testAlloc(job2, models.GenerateUUID()),
+	}
+	if err := state.UpsertAllocs(1000, allocs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.NodeJobSummary(ws, nodeID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := map[string]int{job1.ID: 2, job2.ID: 1}
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	out, err = state.NodeJobSummary(ws, models.GenerateUUID())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	if err := state.UpsertAllocs(1001, []*models.Allocation{testAlloc(job2, nodeID)}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+}
+
+func TestStateStore_CopyOnRead(t *testing.T) {
+	state := testStateStore(t)
+	state.CopyOnRead = true
+	job := testJob()
+	alloc := testAlloc(job, models.GenerateUUID())
+	if err := state.UpsertJob(1000, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertAllocs(1001, []*models.Allocation{alloc}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	outJob, err := state.JobByID(ws, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	outJob.Name = "mutated"
+	outJob.Tasks[0].Type = "mutated"
+	outAlloc, err := state.AllocByID(ws, alloc.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	outAlloc.DesiredStatus = models.AllocDesiredStatusStop
+
+	outJob, err = state.JobByID(ws, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if outJob.Name == "mutated" || outJob.Tasks[0].Type == "mutated" {
+		t.Fatalf("stored job was mutated: %#v", outJob)
+	}
+	outAlloc, err = state.AllocByID(ws, alloc.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if outAlloc.DesiredStatus != models.AllocDesiredStatusRun {
+		t.Fatalf("stored alloc was mutated: %#v", outAlloc)
+	}
+
+	// Snapshots inherit the setting
+	snap, err := state.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	first, _ := snap.JobByID(ws, job.ID)
+	second, _ := snap.JobByID(ws, job.ID)
+	if first == second {
+		t.Fatalf("snapshot returned the stored object")
+	}
+
+	// Without it the stored object itself is returned
+	state.CopyOnRead = false
+	first, _ = state.JobByID(ws, job.ID)
+	second, _ = state.JobByID(ws, job.ID)
+	if first != second {
+		t.Fatalf("expected the stored object")
+	}
+}
+
+func TestStateStore_EvalsByTrigger(t *testing.T) {
+	state := testStateStore(t)
+	triggers := []string{
+		models.EvalTriggerJobRegister,
+		models.EvalTriggerJobRegister,
+		models.EvalTriggerNodeUpdate,
+		"",
+	}
+	var evals []*models.Evaluation
+	for _, trigger := range triggers {
+		eval := testEval()
+		eval.TriggeredBy = trigger
+		evals = append(evals, eval)
+	}
+	if err := state.UpsertEvals(1000, evals); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	evalsByTrigger := func(ws memdb.WatchSet, trigger string) map[string]bool {
+		iter, err := state.EvalsByTrigger(ws, trigger)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		out := make(map[string]bool)
+		for raw := iter.Next(); raw != nil; raw = iter.Next() {
+			out[raw.(*models.Evaluation).ID] = true
+		}
+		return out
+	}
+
+	ws := memdb.NewWatchSet()
+	if out := evalsByTrigger(ws, models.EvalTriggerJobRegister); len(out) != 2 || !out[evals[0].ID] || !out[evals[1].ID] {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out := evalsByTrigger(ws, models.EvalTriggerNodeUpdate); len(out) != 1 || !out[evals[2].ID] {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out := evalsByTrigger(ws, models.EvalTriggerScheduled); len(out) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	eval := testEval()
+	eval.TriggeredBy = models.EvalTriggerNodeUpdate
+	if err := state.UpsertEvals(1001, []*models.Evaluation{eval}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+}
+
+func TestStateStore_DeleteAllocs(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	other := testJob()
+	if err := state.UpsertJob(1000, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertJob(1001, other); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	eval := testEval()
+	eval.JobID = job.ID
+	eval.Status = models.EvalStatusComplete
+	if err := state.UpsertEvals(1002, []*models.Evaluation{eval}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	alloc1 := testAlloc(job, models.GenerateUUID())
+	alloc2 := testAlloc(job, models.GenerateUUID())
+	keep := testAlloc(other, models.GenerateUUID())
+	if err := state.UpsertAllocs(1003, []*models.Allocation{alloc1, alloc2, keep}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.JobByID(ws, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Status != models.JobStatusRunning {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	ids := []string{alloc1.ID, models.GenerateUUID(), alloc2.ID}
+	if err := state.DeleteAllocs(1004, ids); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	ws = memdb.NewWatchSet()
+	allocs, err := state.AllocsByJob(ws, job.ID, true)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(allocs) != 0 {
+		t.Fatalf("bad: %#v", allocs)
+	}
+	if out, _ := state.AllocByID(ws, keep.ID); out == nil {
+		t.Fatalf("unrelated alloc was deleted")
+	}
+
+	// With its allocs gone and its eval complete the job is finished
+	out, err = state.JobByID(ws, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Status != models.JobStatusComplete || out.ModifyIndex != 1004 {
+		t.Fatalf("bad: %#v", out)
+	}
+	if index, _ := state.Index("allocs"); index != 1004 {
+		t.Fatalf("bad index: %d", index)
+	}
+
+	// Only missing IDs leaves the store alone
+	if err := state.DeleteAllocs(1005, []string{models.GenerateUUID()}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if index, _ := state.Index("allocs"); index != 1004 {
+		t.Fatalf("bad index: %d", index)
+	}
+	assertIndexConsistent(t, state)
+}
+
+func TestStateStore_PendingJobsOldestFirst(t *testing.T) {
+	state := testStateStore(t)
+
+	// Insert newest first so the result order isn't the insert order
+	var pending []*models.Job
+	for i := 0; i < 3; i++ {
+		pending = append(pending, testJob())
+	}
+	for i := len(pending) - 1; i >= 0; i-- {
+		if err := state.UpsertJob(uint64(1000+i), pending[i]); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	paused := testJob()
+	if err := state.UpsertJob(999, paused); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpdateJobStatus(1010, paused.ID, models.JobStatusPause); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.PendingJobsOldestFirst(ws)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != len(pending) {
+		t.Fatalf("bad: %#v", out)
+	}
+	for i, job := range out {
+		if job.ID != pending[i].ID {
+			t.Fatalf("bad %d: %#v", i, job)
+		}
+	}
+
+	// A job leaving pending drops off the list
+	if err := state.UpdateJobStatus(1011, pending[0].ID, models.JobStatusRunning); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	out, err = state.PendingJobsOldestFirst(memdb.NewWatchSet())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 2 || out[0].ID != pending[1].ID {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Submit times take precedence over the create index, and jobs
+	// without one predate those with one
+	state = testStateStore(t)
+	now := time.Now()
+	early, late := testJob(), testJob()
+	early.SubmitTime = now.UnixNano()
+	late.SubmitTime = now.Add(time.Minute).UnixNano()
+	legacy := testJob()
+	if err := state.UpsertJob(1000, late); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertJob(1001, legacy); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertJob(1002, early); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err = state.PendingJobsOldestFirst(memdb.NewWatchSet())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 3 || out[0].ID != legacy.ID || out[1].ID != early.ID || out[2].ID != late.ID {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateRestore_EnsureIndexes(t *testing.T) {
+	state := testStateStore(t)
+	restore, err := state.Restore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	node := testNode()
+	node.ModifyIndex = 1005
+	job1 := testJob()
+	job1.ModifyIndex = 1010
+	job2 := testJob()
+	job2.ModifyIndex = 1020
+	eval := testEval()
+	eval.ModifyIndex = 1030
+	if err := restore.NodeRestore(node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, job := range []*models.Job{job1, job2} {
+		if err := restore.JobRestore(job); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := restore.EvalRestore(eval); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Only the evals entry made it into the snapshot
+	if err := restore.IndexRestore(&IndexEntry{"evals", 1040}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := restore.EnsureIndexes(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	restore.Commit()
+
+	expected := map[string]uint64{
+		"nodes":  1005,
+		"jobs":   1020,
+		"evals":  1040,
+		"allocs": 0,
+		"orders": 0,
+	}
+	for table, want := range expected {
+		index, err := state.Index(table)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if index != want {
+			t.Fatalf("bad %s index: %d", table, index)
+		}
+	}
+	assertIndexConsistent(t, state)
+}
+
+func TestStateStore_JobsChan(t *testing.T) {
+	state := testStateStore(t)
+	expected := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		job := testJob()
+		expected[job.ID] = true
+		if err := state.UpsertJob(uint64(1000+i), job); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	ch, errCh, err := state.JobsChan(context.Background(), memdb.NewWatchSet())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	got := make(map[string]bool)
+	for job := range ch {
+		got[job.ID] = true
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad: %#v", got)
+	}
+
+	// Cancelling stops the stream early and closes the channel
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, _, err = state.JobsChan(ctx, memdb.NewWatchSet())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	<-ch
+	cancel()
+	count := 0
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				done = true
+				break
+			}
+			count++
+		case <-timeout:
+			t.Fatalf("channel not closed")
+		}
+	}
+	if count > 1 {
+		t.Fatalf("stream did not stop: %d", count)
+	}
+}
+
+func TestStream_TypeMismatch(t *testing.T) {
+	state := testStateStore(t)
+	if err := state.UpsertJob(1000, testJob()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	iter, err := state.Jobs(memdb.NewWatchSet())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ch, errCh := Stream[*models.Node](context.Background(), iter)
+	for node := range ch {
+		t.Fatalf("bad: %#v", node)
+	}
+	if err := <-errCh; err == nil {
+		t.Fatalf("expected error for mismatched type")
+	}
+}
+
+func TestStateStore_RegisterJob(t *testing.T) {
+	state := testStateStore(t)
+	job := testJob()
+	eval := testEval()
+	eval.JobID = job.ID
+	if err := state.RegisterJob(1000, job, eval); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	outJob, err := state.JobByID(ws, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if outJob == nil || outJob.Status != models.JobStatusPending || outJob.CreateIndex != 1000 {
+		t.Fatalf("bad: %#v", outJob)
+	}
+	outEval, err := state.EvalByID(ws, eval.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if outEval == nil || outEval.CreateIndex != 1000 {
+		t.Fatalf("bad: %#v", outEval)
+	}
+	for _, table := range []string{"jobs", "evals"} {
+		if index, _ := state.Index(table); index != 1000 {
+			t.Fatalf("bad %s index: %d", table, index)
+		}
+	}
+
+	// A failing eval upsert rolls back the job
+	job2 := testJob()
+	badEval := testEval()
+	badEval.ID = ""
+	badEval.JobID = job2.ID
+	if err := state.RegisterJob(1001, job2, badEval); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// A failing job upsert rolls back the eval
+	badJob := testJob()
+	badJob.ID = ""
+	eval3 := testEval()
+	eval3.JobID = ""
+	if err := state.RegisterJob(1002, badJob, eval3); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// An eval for another job is rejected
+	if err := state.RegisterJob(1003, testJob(), testEval()); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	if out, _ := state.JobByID(ws, job2.ID); out != nil {
+		t.Fatalf("job was not rolled back: %#v", out)
+	}
+	if out, _ := state.EvalByID(ws, eval3.ID); out != nil {
+		t.Fatalf("eval was not rolled back: %#v", out)
+	}
+	for _, table := range []string{"jobs", "evals"} {
+		if index, _ := state.Index(table); index != 1000 {
+			t.Fatalf("bad %s index: %d", table, index)
+		}
+	}
+}
+
+func TestStateStore_AckEval(t *testing.T) {
+	state := testStateStore(t)
+	eval1 := testEval()
+	eval1.SnapshotIndex = 900
+	eval2 := testEval()
+	if err := state.UpsertEvals(1000, []*models.Evaluation{eval1, eval2}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	unacked, err := state.EvalsUnacked(ws)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(unacked) != 2 {
+		t.Fatalf("bad: %#v", unacked)
+	}
+
+	if err := state.AckEval(1001, eval1.ID, "worker-1"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	if err := state.AckEval(1002, models.GenerateUUID(), "worker-1"); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	out, err := state.EvalByID(memdb.NewWatchSet(), eval1.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.ProcessedBy != "worker-1" || out.AckIndex != 1001 || out.ModifyIndex != 1001 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// The ack doesn't touch the scheduler's snapshot index
+	if out.SnapshotIndex != 900 {
+		t.Fatalf("bad snapshot index: %d", out.SnapshotIndex)
+	}
+	if out.Status != models.EvalStatusPending {
+		t.Fatalf("status changed: %#v", out)
+	}
+
+	unacked, err = state.EvalsUnacked(memdb.NewWatchSet())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(unacked) != 1 || unacked[0].ID != eval2.ID {
+		t.Fatalf("bad: %#v", unacked)
+	}
+	if index, _ := state.Index("evals"); index != 1001 {
+		t.Fatalf("bad index: %d", index)
+	}
+}
+
+func TestStateStore_JobsSubmittedBetween(t *testing.T) {
+	state := testStateStore(t)
+
+	base := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	var jobs []*models.Job
+	for i := 0; i < 5; i++ {
+		job := testJob()
+		job.SubmitTime = base.Add(time.Duration(i) * time.Hour).UnixNano()
+		jobs = append(jobs, job)
+	}
+	unsubmitted := testJob()
+	jobs = append(jobs, unsubmitted)
+	for i, job := range jobs {
+		if err := state.UpsertJob(uint64(1000+i), job); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Both bounds are inclusive
+	ws := memdb.NewWatchSet()
+	out, err := state.JobsSubmittedBetween(ws, base.Add(time.Hour), base.Add(3*time.Hour))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 3 {
+		t.Fatalf("bad: %#v", out)
+	}
+	got := make(map[string]bool)
+	for _, job := range out {
+		got[job.ID] = true
+	}
+	for _, job := range jobs[1:4] {
+		if !got[job.ID] {
+			t.Fatalf("missing job %s", job.ID)
+		}
+	}
+
+	// Jobs without a submit time never match, even from the zero time
+	out, err = state.JobsSubmittedBetween(ws, time.Unix(0, 0), base.Add(10*time.Hour))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 5 {
+		t.Fatalf("bad: %#v", out)
+	}
+	for _, job := range out {
+		if job.ID == unsubmitted.ID {
+			t.Fatalf("bad: %#v", job)
+		}
+	}
+
+	out, err = state.JobsSubmittedBetween(ws, base.Add(10*time.Hour), base.Add(20*time.Hour))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_UnblockEvalsForJob(t *testing.T) {
+	state := testStateStore(t)
+
+	job := testJob()
+	if err := state.UpsertJob(999, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var blocked []*models.Evaluation
+	for i := 0; i < 2; i++ {
+		eval := testEval()
+		eval.JobID = job.ID
+		eval.Status = models.EvalStatusBlocked
+		blocked = append(blocked, eval)
+	}
+	complete := testEval()
+	complete.JobID = job.ID
+	complete.Status = models.EvalStatusFailed
+	other := testEval()
+	other.Status = models.EvalStatusBlocked
+	evals := append([]*models.Evaluation{complete, other}, blocked...)
+	if err := state.UpsertEvals(1000, evals); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	if _, err := state.EvalByID(ws, blocked[0].ID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	n, err := state.UnblockEvalsForJob(1001, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	for _, eval := range blocked {
+		out, err := state.EvalByID(nil, eval.ID)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out.Status != models.EvalStatusPending || out.ModifyIndex != 1001 {
+			t.Fatalf("bad: %#v", out)
+		}
+	}
+
+	// Other statuses and other jobs' blocked evals are left alone
+	out, err := state.EvalByID(nil, complete.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Status != models.EvalStatusFailed || out.ModifyIndex != 1000 {
+		t.Fatalf("bad: %#v", out)
+	}
+	out, err = state.EvalByID(nil, other.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Status != models.EvalStatusBlocked {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	index, err := state.Index("evals")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if index != 1001 {
+		t.Fatalf("bad: %d", index)
+	}
+
+	// Nothing left to unblock
+	n, err = state.UnblockEvalsForJob(1002, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestStateStore_GarbageCollect_ReplacedAllocs(t *testing.T) {
+	state := testStateStore(t)
+
+	job := testJob()
+	if err := state.UpsertJob(1000, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A failed alloc whose replacement is running
+	replaced := testAlloc(job, models.GenerateUUID())
+	replaced.ClientStatus = models.AllocClientStatusFailed
+	replacement := testAlloc(job, models.GenerateUUID())
+	replacement.PreviousAllocation = replaced.ID
+	replacement.ClientStatus = models.AllocClientStatusRunning
+
+	// A second running alloc replacing the same one
+	sibling := testAlloc(job, models.GenerateUUID())
+	sibling.PreviousAllocation = replaced.ID
+	sibling.ClientStatus = models.AllocClientStatusRunning
+
+	// A failed alloc whose replacement hasn't started yet
+	waiting := testAlloc(job, models.GenerateUUID())
+	waiting.ClientStatus = models.AllocClientStatusFailed
+	pending := testAlloc(job, models.GenerateUUID())
+	pending.PreviousAllocation = waiting.ID
+
+	// A failed alloc that was never replaced
+	unreplaced := testAlloc(job, models.GenerateUUID())
+	unreplaced.ClientStatus = models.AllocClientStatusFailed
+
+	allocs := []*models.Allocation{replaced, replacement, sibling, waiting, pending, unreplaced}
+	if err := state.UpsertAllocs(1001, allocs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A threshold below every alloc only leaves the replacement rule
+	stats, err := state.GarbageCollect(1002, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats.ReplacedAllocs != 1 || stats.Allocs != 0 || stats.OrphanedAllocs != 0 {
+		t.Fatalf("bad: %#v", stats)
+	}
+
+	out, err := state.AllocByID(nil, replaced.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != nil {
+		t.Fatalf("bad: %#v", out)
+	}
+	for _, alloc := range []*models.Allocation{replacement, sibling, waiting, pending, unreplaced} {
+		out, err := state.AllocByID(nil, alloc.ID)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out == nil {
+			t.Fatalf("alloc %s collected", alloc.ID)
+		}
+	}
+
+	index, err := state.Index("allocs")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if index != 1002 {
+		t.Fatalf("bad: %d", index)
+	}
+	assertIndexConsistent(t, state)
+}
+
+func TestStateStore_IdleNodes(t *testing.T) {
+	state := testStateStore(t)
+
+	busy := testNode()
+	stopped := testNode()
+	empty := testNode()
+	down := testNode()
+	down.Status = models.NodeStatusDown
+	for i, node := range []*models.Node{busy, stopped, empty, down} {
+		if err := state.UpsertNode(uint64(1000+i), node); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	job := testJob()
+	running := testAlloc(job, busy.ID)
+	running.ClientStatus = models.AllocClientStatusRunning
+	failed := testAlloc(job, stopped.ID)
+	failed.ClientStatus = models.AllocClientStatusFailed
+	if err := state.UpsertAllocs(1010, []*models.Allocation{running, failed}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.IdleNodes(ws)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	got := make(map[string]bool)
+	for _, node := range out {
+		got[node.ID] = true
+	}
+	if len(out) != 2 || !got[stopped.ID] || !got[empty.ID] {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Once its alloc finishes the busy node is idle too
+	done := running.Copy()
+	done.ClientStatus = models.AllocClientStatusComplete
+	if err := state.UpdateAllocsFromClient(1011, []*models.Allocation{done}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	out, err = state.IdleNodes(memdb.NewWatchSet())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 3 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateSnapshot_SnapshotIndex(t *testing.T) {
+	state := testStateStore(t)
+
+	if err := state.UpsertNode(1000, testNode()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertJob(1001, testJob()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	latest, err := state.LatestIndex()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	snap, err := state.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	partial, err := state.PartialSnapshot([]string{"nodes"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Later writes don't move the snapshots' index
+	if err := state.UpsertJob(1002, testJob()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if idx := snap.SnapshotIndex(); idx != latest || idx != 1001 {
+		t.Fatalf("bad: %d", idx)
+	}
+
+	// The partial snapshot only holds nodes but still reports the store's
+	// index rather than the highest among its own tables
+	if idx := partial.SnapshotIndex(); idx != latest {
+		t.Fatalf("bad: %d", idx)
+	}
+	own, err := partial.LatestIndex()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if own != 1000 {
+		t.Fatalf("bad: %d", own)
+	}
+}
+
+func TestStateRestore_Restore(t *testing.T) {
+	state := testStateStore(t)
+	restore, err := state.Restore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	node := testNode()
+	job := testJob()
+	order := &models.Order{ID: models.GenerateUUID()}
+	eval := testEval()
+	alloc := testAlloc(job, node.ID)
+	stats := &models.AllocStats{
+		AllocID:     alloc.ID,
+		Stats:       &models.AllocStatistics{},
+		CreateIndex: 1000,
+		ModifyIndex: 1000,
+	}
+	idx := &IndexEntry{"jobs", 1000}
+	objs := map[string]interface{}{
+		"nodes":       node,
+		"jobs":        job,
+		"orders":      order,
+		"evals":       eval,
+		"allocs":      alloc,
+		"alloc_stats": stats,
+		"index":       idx,
+	}
+	for table, obj := range objs {
+		if err := restore.Restore(table, obj); err != nil {
+			t.Fatalf("%s: %v", table, err)
+		}
+	}
+
+	// Unknown tables and mismatched types are rejected
+	if err := restore.Restore("bogus", node); err == nil {
+		t.Fatalf("expected unknown table error")
+	}
+	if err := restore.Restore("jobs", node); err == nil {
+		t.Fatalf("expected type error")
+	}
+	restore.Commit()
+
+	ws := memdb.NewWatchSet()
+	if out, err := state.NodeByID(ws, node.ID); err != nil || !reflect.DeepEqual(out, node) {
+		t.Fatalf("bad: %#v %v", out, err)
+	}
+	if out, err := state.JobByID(ws, job.ID); err != nil || !reflect.DeepEqual(out, job) {
+		t.Fatalf("bad: %#v %v", out, err)
+	}
+	if out, err := state.OrderByID(ws, order.ID); err != nil || !reflect.DeepEqual(out, order) {
+		t.Fatalf("bad: %#v %v", out, err)
+	}
+	if out, err := state.EvalByID(ws, eval.ID); err != nil || !reflect.DeepEqual(out, eval) {
+		t.Fatalf("bad: %#v %v", out, err)
+	}
+	if out, err := state.AllocByID(ws, alloc.ID); err != nil || !reflect.DeepEqual(out, alloc) {
+		t.Fatalf("bad: %#v %v", out, err)
+	}
+	if out, err := state.AllocStatsByID(ws, alloc.ID); err != nil || !reflect.DeepEqual(out, stats) {
+		t.Fatalf("bad: %#v %v", out, err)
+	}
+	if index, err := state.Index("jobs"); err != nil || index != 1000 {
+		t.Fatalf("bad: %d %v", index, err)
+	}
+}
+
+func TestStateStore_JobActivity(t *testing.T) {
+	state := testStateStore(t)
+
+	job := testJob()
+	if err := state.UpsertJob(999, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	eval1 := testEval()
+	eval1.JobID = job.ID
+	if err := state.UpsertEvals(1000, []*models.Evaluation{eval1}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	alloc1 := testAlloc(job, models.GenerateUUID())
+	alloc1.EvalID = eval1.ID
+	if err := state.UpsertAllocs(1001, []*models.Allocation{alloc1}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	eval2 := testEval()
+	eval2.JobID = job.ID
+	if err := state.UpsertEvals(1002, []*models.Evaluation{eval2}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The client update moves alloc1 after eval2
+	update := alloc1.Copy()
+	update.ClientStatus = models.AllocClientStatusRunning
+	if err := state.UpdateAllocsFromClient(1003, []*models.Allocation{update}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	alloc2 := testAlloc(job, models.GenerateUUID())
+	alloc2.EvalID = eval2.ID
+	if err := state.UpsertAllocs(1003, []*models.Allocation{alloc2}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Another job's activity is left out
+	other := testEval()
+	if err := state.UpsertEvals(1004, []*models.Evaluation{other}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.JobActivity(ws, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 4 {
+		t.Fatalf("bad: %#v", out)
+	}
+	if out[0].Eval == nil || out[0].Eval.ID != eval1.ID {
+		t.Fatalf("bad 0: %#v", out[0])
+	}
+	if out[1].Eval == nil || out[1].Eval.ID != eval2.ID {
+		t.Fatalf("bad 1: %#v", out[1])
+	}
+	for i := 2; i < 4; i++ {
+		if out[i].Alloc == nil || out[i].Eval != nil || out[i].Index != 1003 {
+			t.Fatalf("bad %d: %#v", i, out[i])
+		}
+	}
+	for i := 1; i < len(out); i++ {
+		if out[i].Index < out[i-1].Index {
+			t.Fatalf("out of order: %#v", out)
+		}
+	}
+
+	eval3 := testEval()
+	eval3.JobID = job.ID
+	if err := state.UpsertEvals(1005, []*models.Evaluation{eval3}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+}
+
+func TestStateStore_IndexTableKeys(t *testing.T) {
+	state := testStateStore(t)
+
+	node := testNode()
+	job := testJob()
+	eval := testEval()
+	eval.JobID = job.ID
+	alloc := testAlloc(job, node.ID)
+	if err := state.UpsertNode(1000, node); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertJob(1001, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertOrder(1002, &models.Order{ID: models.GenerateUUID()}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertEvals(1003, []*models.Evaluation{eval}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertAllocs(1004, []*models.Allocation{alloc}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpdateNodeStatus(1005, node.ID, models.NodeStatusDown, 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	keys, err := state.IndexTableKeys()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"allocs", "evals", "jobs", "nodes", "orders"}) {
+		t.Fatalf("bad: %#v", keys)
+	}
+
+	// A stray entry is reported alongside the table names
+	restore, err := state.Restore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := restore.IndexRestore(&IndexEntry{"bogus", 1006}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	restore.Commit()
+
+	keys, err = state.IndexTableKeys()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(keys) != 6 || keys[1] != "bogus" {
+		t.Fatalf("bad: %#v", keys)
+	}
+}
+
+func TestStateStore_AllocStats(t *testing.T) {
+	state := testStateStore(t)
+
+	job := testJob()
+	alloc := testAlloc(job, models.GenerateUUID())
+	if err := state.UpsertAllocs(1000, []*models.Allocation{alloc}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Stats for an unknown alloc are rejected
+	if err := state.UpsertAllocStats(1001, &models.AllocStats{AllocID: models.GenerateUUID()}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.AllocStatsByID(ws, alloc.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != nil {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	stats := &models.AllocStats{
+		AllocID: alloc.ID,
+		Stats: &models.AllocStatistics{
+			Tasks: map[string]*models.TaskStatistics{
+				models.TaskTypeSrc: {ExecMasterTxCount: 10, Backlog: "0/1024"},
+			},
+		},
+	}
+	if err := state.UpsertAllocStats(1002, stats); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	update := &models.AllocStats{
+		AllocID: alloc.ID,
+		Stats: &models.AllocStatistics{
+			Tasks: map[string]*models.TaskStatistics{
+				models.TaskTypeSrc: {ExecMasterTxCount: 20, Backlog: "1/1024"},
+			},
+		},
+	}
+	if err := state.UpsertAllocStats(1003, update); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws = memdb.NewWatchSet()
+	out, err = state.AllocStatsByID(ws, alloc.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(out.Stats, update.Stats) || out.CreateIndex != 1002 || out.ModifyIndex != 1003 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Writing stats leaves the alloc itself untouched
+	a, err := state.AllocByID(nil, alloc.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if a.ModifyIndex != 1000 {
+		t.Fatalf("bad: %#v", a)
+	}
+
+	// Deleting the alloc drops its stats
+	if err := state.DeleteAllocs(1004, []string{alloc.ID}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	out, err = state.AllocStatsByID(nil, alloc.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != nil {
+		t.Fatalf("bad: %#v", out)
+	}
+	index, err := state.Index("alloc_stats")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if index != 1004 {
+		t.Fatalf("bad: %d", index)
+	}
+	assertIndexConsistent(t, state)
+}
+
+func TestStateStore_MigratedAllocs(t *testing.T) {
+	state := testStateStore(t)
+
+	job := testJob()
+	node1, node2 := models.GenerateUUID(), models.GenerateUUID()
+
+	// Replaced on another node
+	prev1 := testAlloc(job, node1)
+	prev1.ClientStatus = models.AllocClientStatusFailed
+	migrated := testAlloc(job, node2)
+	migrated.PreviousAllocation = prev1.ID
+
+	// Replaced on the same node
+	prev2 := testAlloc(job, node1)
+	prev2.ClientStatus = models.AllocClientStatusFailed
+	inPlace := testAlloc(job, node1)
+	inPlace.PreviousAllocation = prev2.ID
+
+	// The predecessor is gone
+	orphan := testAlloc(job, node2)
+	orphan.PreviousAllocation = models.GenerateUUID()
+
+	allocs := []*models.Allocation{prev1, migrated, prev2, inPlace, orphan}
+	if err := state.UpsertAllocs(1000, allocs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.MigratedAllocs(ws)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 1 || out[0].ID != migrated.ID {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	moved := testAlloc(job, node2)
+	moved.PreviousAllocation = inPlace.ID
+	if err := state.UpsertAllocs(1001, []*models.Allocation{moved}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	out, err = state.MigratedAllocs(memdb.NewWatchSet())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateRestore_Timings(t *testing.T) {
+	state := testStateStore(t)
+	restore, err := state.Restore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Disabled by default
+	if err := restore.NodeRestore(testNode()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if timings := restore.Timings(); timings != nil {
+		t.Fatalf("bad: %#v", timings)
+	}
+
+	restore.EnableTimings()
+	for i := 0; i < 1000; i++ {
+		job := testJob()
+		if err := restore.JobRestore(job); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := restore.AllocRestore(testAlloc(job, models.GenerateUUID())); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := restore.IndexRestore(&IndexEntry{"jobs", 1000}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	restore.Commit()
+
+	timings := restore.Timings()
+	if len(timings) != 3 {
+		t.Fatalf("bad: %#v", timings)
+	}
+	for _, table := range []string{"jobs", "allocs", "index"} {
+		if timings[table] <= 0 {
+			t.Fatalf("bad %s: %#v", table, timings)
+		}
+	}
+
+	// Timings only cover inserts made after they were enabled
+	if _, ok := timings["nodes"]; ok {
+		t.Fatalf("bad: %#v", timings)
+	}
+}
+
+func TestStateStore_EvalChain(t *testing.T) {
+	state := testStateStore(t)
+
+	// first -> (next) second -> (blocked) third
+	first := testEval()
+	second := first.NextRollingEval(0)
+	third := second.CreateBlockedEval(nil, false)
+	first.NextEval = second.ID
+	second.BlockedEval = third.ID
+	unrelated := testEval()
+	evals := []*models.Evaluation{first, second, third, unrelated}
+	if err := state.UpsertEvals(1000, evals); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	want := []string{third.ID, second.ID, first.ID}
+	for _, start := range evals[:3] {
+		out, err := state.EvalChain(memdb.NewWatchSet(), start.ID)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var got []string
+		for _, eval := range out {
+			got = append(got, eval.ID)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("bad from %s: %#v", start.ID, got)
+		}
+	}
+
+	out, err := state.EvalChain(memdb.NewWatchSet(), unrelated.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 1 || out[0].ID != unrelated.ID {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	out, err = state.EvalChain(memdb.NewWatchSet(), models.GenerateUUID())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out != nil {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// The chain stops at a collected link
+	if err := state.DeleteEval(1001, []string{first.ID}, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err = state.EvalChain(memdb.NewWatchSet(), third.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 2 || out[1].ID != second.ID {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_JobsByMinPriority(t *testing.T) {
+	state := testStateStore(t)
+
+	priorities := []int{10, 50, 70, 50, 90}
+	jobs := make(map[string]int)
+	for i, p := range priorities {
+		job := testJob()
+		job.Priority = p
+		jobs[job.ID] = p
+		if err := state.UpsertJob(uint64(1000+i), job); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.JobsByMinPriority(ws, 50)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 4 {
+		t.Fatalf("bad: %#v", out)
+	}
+	for i, job := range out {
+		if job.Priority < 50 || job.Priority != jobs[job.ID] {
+			t.Fatalf("bad %d: %#v", i, job)
+		}
+		if i > 0 && job.Priority > out[i-1].Priority {
+			t.Fatalf("not ordered by priority: %#v", out)
+		}
+	}
+	if out[0].Priority != 90 {
+		t.Fatalf("bad: %#v", out[0])
+	}
+
+	out, err = state.JobsByMinPriority(ws, 91)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	urgent := testJob()
+	urgent.Priority = 100
+	if err := state.UpsertJob(1010, urgent); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+}
+
+func TestStateStore_AllocsStaleClientStatus(t *testing.T) {
+	state := testStateStore(t)
+
+	job := testJob()
+	stale := testAlloc(job, models.GenerateUUID())
+	stale.ClientStatus = models.AllocClientStatusRunning
+	finished := testAlloc(job, models.GenerateUUID())
+	finished.ClientStatus = models.AllocClientStatusComplete
+	stopped := testAlloc(job, models.GenerateUUID())
+	stopped.DesiredStatus = models.AllocDesiredStatusStop
+	if err := state.UpsertAllocs(1000, []*models.Allocation{stale, finished, stopped}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fresh := testAlloc(job, models.GenerateUUID())
+	fresh.ClientStatus = models.AllocClientStatusRunning
+	if err := state.UpsertAllocs(1010, []*models.Allocation{fresh}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.AllocsStaleClientStatus(ws, 1010)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 1 || out[0].ID != stale.ID {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// A client update makes the alloc fresh again
+	update := stale.Copy()
+	update.ClientStatus = models.AllocClientStatusRunning
+	if err := state.UpdateAllocsFromClient(1011, []*models.Allocation{update}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+	out, err = state.AllocsStaleClientStatus(memdb.NewWatchSet(), 1011)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 1 || out[0].ID != fresh.ID {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_MarkAllocsLost(t *testing.T) {
+	state := testStateStore(t)
+
+	job := testJob()
+	if err := state.UpsertJob(999, job); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	running := testAlloc(job, models.GenerateUUID())
+	running.ClientStatus = models.AllocClientStatusRunning
+	failed := testAlloc(job, models.GenerateUUID())
+	failed.ClientStatus = models.AllocClientStatusFailed
+	if err := state.UpsertAllocs(1000, []*models.Allocation{running, failed}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out, err := state.JobByID(nil, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Status != models.JobStatusRunning {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	ws := memdb.NewWatchSet()
+	if _, err := state.AllocByID(ws, running.ID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ids := []string{running.ID, failed.ID, models.GenerateUUID()}
+	if err := state.MarkAllocsLost(1001, ids); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	lost, err := state.AllocByID(nil, running.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if lost.ClientStatus != models.AllocClientStatusLost || lost.ModifyIndex != 1001 {
+		t.Fatalf("bad: %#v", lost)
+	}
+	untouched, err := state.AllocByID(nil, failed.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if untouched.ClientStatus != models.AllocClientStatusFailed || untouched.ModifyIndex != 1000 {
+		t.Fatalf("bad: %#v", untouched)
+	}
+
+	// With no live allocs left the job is no longer running
+	out, err = state.JobByID(nil, job.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Status != models.JobStatusComplete || out.ModifyIndex != 1001 {
+		t.Fatalf("bad: %#v", out)
+	}
+	assertIndexConsistent(t, state)
+}
+
+func TestStateStore_ClusterSummary(t *testing.T) {
+	state := testStateStore(t)
+
+	down := testNode()
+	down.Status = models.NodeStatusDown
+	nodes := []*models.Node{testNode(), testNode(), down}
+	for i, node := range nodes {
+		if err := state.UpsertNode(uint64(1000+i), node); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	job1, job2 := testJob(), testJob()
+	if err := state.UpsertJob(1010, job1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertJob(1011, job2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	running := testAlloc(job1, nodes[0].ID)
+	running.ClientStatus = models.AllocClientStatusRunning
+	failed := testAlloc(job1, nodes[1].ID)
+	failed.ClientStatus = models.AllocClientStatusFailed
+	pending := testAlloc(job1, nodes[1].ID)
+	if err := state.UpsertAllocs(1020, []*models.Allocation{running, failed, pending}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	summary, err := state.ClusterSummary()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Compare against the individual queries
+	ws := memdb.NewWatchSet()
+	nodeCounts := make(map[string]int)
+	iter, err := state.Nodes(ws)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		nodeCounts[raw.(*models.Node).Status]++
+	}
+	jobCounts := make(map[string]int)
+	iter, err = state.Jobs(ws)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		jobCounts[raw.(*models.Job).Status]++
+	}
+	allocCounts := make(map[string]int)
+	iter, err = state.Allocs(ws)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		allocCounts[raw.(*models.Allocation).ClientStatus]++
+	}
+	latest, err := state.LatestIndex()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if !reflect.DeepEqual(summary.NodesByStatus, nodeCounts) {
+		t.Fatalf("bad nodes: %#v %#v", summary.NodesByStatus, nodeCounts)
+	}
+	if !reflect.DeepEqual(summary.JobsByStatus, jobCounts) {
+		t.Fatalf("bad jobs: %#v %#v", summary.JobsByStatus, jobCounts)
+	}
+	if !reflect.DeepEqual(summary.AllocsByClientStatus, allocCounts) {
+		t.Fatalf("bad allocs: %#v %#v", summary.AllocsByClientStatus, allocCounts)
+	}
+	if summary.Index != latest {
+		t.Fatalf("bad: %d %d", summary.Index, latest)
+	}
+
+	// Spot check the seeded values
+	if summary.NodesByStatus[models.NodeStatusReady] != 2 || summary.NodesByStatus[models.NodeStatusDown] != 1 {
+		t.Fatalf("bad: %#v", summary.NodesByStatus)
+	}
+	if summary.JobsByStatus[models.JobStatusRunning] != 1 || summary.JobsByStatus[models.JobStatusPending] != 1 {
+		t.Fatalf("bad: %#v", summary.JobsByStatus)
+	}
+	if summary.AllocsByClientStatus[models.AllocClientStatusRunning] != 1 ||
+		summary.AllocsByClientStatus[models.AllocClientStatusFailed] != 1 ||
+		summary.AllocsByClientStatus[models.AllocClientStatusPending] != 1 {
+		t.Fatalf("bad: %#v", summary.AllocsByClientStatus)
+	}
+}
+
+func TestStateStore_BlockingJobs(t *testing.T) {
+	state := testStateStore(t)
+	job1 := testJob()
+	if err := state.UpsertJob(1000, job1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Already past minIndex, returns right away
+	out, index, err := state.BlockingJobs(context.Background(), 999)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 1 || index != 1000 {
+		t.Fatalf("bad: %d %#v", index, out)
+	}
+
+	type result struct {
+		jobs  []*models.Job
+		index uint64
+		err   error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		jobs, index, err := state.BlockingJobs(context.Background(), 1000)
+		resultCh <- result{jobs, index, err}
+	}()
+
+	// Writes to other tables don't unblock the call
+	if err := state.UpsertNode(1001, testNode()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case res := <-resultCh:
+		t.Fatalf("returned early: %#v", res)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	job2 := testJob()
+	if err := state.UpsertJob(1002, job2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case res := <-resultCh:
+		if res.err != nil {
+			t.Fatalf("err: %v", res.err)
+		}
+		if len(res.jobs) != 2 || res.index != 1002 {
+			t.Fatalf("bad: %d %#v", res.index, res.jobs)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("call did not unblock")
+	}
+
+	// A cancelled context ends the wait
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := state.BlockingJobs(ctx, 1002); err != context.DeadlineExceeded {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestStateStore_DeleteNodeCascade(t *testing.T) {
+	for _, remove := range []bool{true, false} {
+		state := testStateStore(t)
+
+		node, other := testNode(), testNode()
+		if err := state.UpsertNode(1000, node); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := state.UpsertNode(1001, other); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		job := testJob()
+		if err := state.UpsertJob(1002, job); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		running := testAlloc(job, node.ID)
+		running.ClientStatus = models.AllocClientStatusRunning
+		failed := testAlloc(job, node.ID)
+		failed.ClientStatus = models.AllocClientStatusFailed
+		kept := testAlloc(testJob(), other.ID)
+		if err := state.UpsertAllocs(1003, []*models.Allocation{running, failed, kept}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		if err := state.DeleteNodeCascade(1004, node.ID, remove); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := state.DeleteNodeCascade(1005, node.ID, remove); err == nil {
+			t.Fatalf("expected error deleting a missing node")
+		}
+
+		out, err := state.NodeByID(nil, node.ID)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out != nil {
+			t.Fatalf("bad: %#v", out)
+		}
+
+		allocs, err := state.AllocsByNode(nil, node.ID)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if remove {
+			if len(allocs) != 0 {
+				t.Fatalf("bad: %#v", allocs)
+			}
+		} else {
+			if len(allocs) != 2 {
+				t.Fatalf("bad: %#v", allocs)
+			}
+			for _, alloc := range allocs {
+				want, index := models.AllocClientStatusLost, uint64(1004)
+				if alloc.ID == failed.ID {
+					want, index = models.AllocClientStatusFailed, 1003
+				}
+				if alloc.ClientStatus != want || alloc.ModifyIndex != index {
+					t.Fatalf("bad: %#v", alloc)
+				}
+			}
+		}
+
+		// Allocs on other nodes are untouched
+		a, err := state.AllocByID(nil, kept.ID)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if a == nil || a.ModifyIndex != 1003 {
+			t.Fatalf("bad: %#v", a)
+		}
+
+		// The job lost its only live alloc
+		j, err := state.JobByID(nil, job.ID)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if j.Status == models.JobStatusRunning {
+			t.Fatalf("bad: %#v", j)
+		}
+		assertIndexConsistent(t, state)
+	}
+}
+
+func TestStateStore_EvalsWaitingUntilBefore(t *testing.T) {
+	state := testStateStore(t)
+
+	now := time.Now()
+	late := testEval()
+	late.WaitUntil = now.Add(-time.Minute)
+	early := testEval()
+	early.WaitUntil = now.Add(-time.Hour)
+	future := testEval()
+	future.WaitUntil = now.Add(time.Hour)
+	immediate := testEval()
+	done := testEval()
+	done.Status = models.EvalStatusComplete
+	done.WaitUntil = now.Add(-2 * time.Hour)
+	evals := []*models.Evaluation{late, early, future, immediate, done}
+	if err := state.UpsertEvals(1000, evals); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.EvalsWaitingUntilBefore(ws, now)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 2 || out[0].ID != early.ID || out[1].ID != late.ID {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	out, err = state.EvalsWaitingUntilBefore(ws, now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 3 || out[2].ID != future.ID {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	delayed := testEval()
+	delayed.WaitUntil = now.Add(-time.Second)
+	if err := state.UpsertEvals(1001, []*models.Evaluation{delayed}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+}
+
+func TestStateStore_BumpIndexes(t *testing.T) {
+	state := testStateStore(t)
+
+	if err := state.UpsertJob(2000, testJob()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.UpsertNode(1000, testNode()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Unknown tables reject the whole call
+	if err := state.BumpIndexes(1500, []string{"nodes", "bogus"}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if err := state.BumpIndexes(1500, []string{"index"}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if index, _ := state.Index("nodes"); index != 1000 {
+		t.Fatalf("bad: %d", index)
+	}
+
+	if err := state.BumpIndexes(1500, []string{"nodes", "jobs", "evals"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The jobs index was already past 1500 and is not moved back
+	expected := map[string]uint64{"nodes": 1500, "jobs": 2000, "evals": 1500}
+	for table, want := range expected {
+		index, err := state.Index(table)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if index != want {
+			t.Fatalf("bad %s index: %d", table, index)
+		}
+	}
+}
+
+func TestStateStore_JobsTargetingNodeClass(t *testing.T) {
+	state := testStateStore(t)
+
+	pinned := testJob()
+	pinned.Constraints = []*models.Constraint{
+		{LTarget: "${node.class}", RTarget: "apply", Operand: "="},
+	}
+	taskPinned := testJob()
+	taskPinned.Tasks[1].Constraints = []*models.Constraint{
+		{LTarget: "${node.class}", RTarget: "apply", Operand: "=="},
+	}
+	excluded := testJob()
+	excluded.Constraints = []*models.Constraint{
+		{LTarget: "${node.class}", RTarget: "apply", Operand: "!="},
+	}
+	elsewhere := testJob()
+	elsewhere.Constraints = []*models.Constraint{
+		{LTarget: "${node.class}", RTarget: "extract", Operand: "="},
+	}
+	reversed := testJob()
+	reversed.Constraints = []*models.Constraint{
+		{LTarget: "apply", RTarget: "${node.class}", Operand: "is"},
+	}
+
+	// Only equality against the literal ${node.class} target counts
+	rejected := testJob()
+	rejected.Constraints = []*models.Constraint{
+		{LTarget: "${node.class}", RTarget: "apply", Operand: "regexp"},
+		{LTarget: "${node.class}", RTarget: "apply", Operand: "set_contains"},
+		{LTarget: "${node.class}", RTarget: "apply", Operand: "<"},
+		{LTarget: "${node.class}", RTarget: "apply", Operand: ""},
+		{LTarget: "${ node.class }", RTarget: "apply", Operand: "="},
+		{LTarget: "${attr.class}", RTarget: "apply", Operand: "="},
+		{LTarget: "node.class", RTarget: "apply", Operand: "="},
+		{LTarget: "${node.class}", RTarget: "${node.class}", Operand: "="},
+		nil,
+	}
+	unconstrained := testJob()
+	for i, job := range []*models.Job{pinned, taskPinned, excluded, elsewhere, reversed, rejected, unconstrained} {
+		if err := state.UpsertJob(uint64(1000+i), job); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	ws := memdb.NewWatchSet()
+	out, err := state.JobsTargetingNodeClass(ws, "apply")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	got := make(map[string]bool)
+	for _, job := range out {
+		got[job.ID] = true
+	}
+	if len(out) != 3 || !got[pinned.ID] || !got[taskPinned.ID] || !got[reversed.ID] {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	out, err = state.JobsTargetingNodeClass(ws, "missing")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestStateStore_WatchAllocDesiredStatus(t *testing.T) {
+	state := testStateStore(t)
+
+	job := testJob()
+	alloc1 := testAlloc(job, models.GenerateUUID())
+	alloc2 := testAlloc(job, models.GenerateUUID())
+	if err := state.UpsertAllocs(1000, []*models.Allocation{alloc1, alloc2}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := state.SetAllocDesiredStatus(1001, alloc2.ID, models.AllocDesiredStatusPause); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := state.WatchAllocDesiredStatus(ctx, 1000)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	recv := func() *models.Allocation {
+		select {
+		case alloc := <-ch:
+			return alloc
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for alloc")
+		}
+		return nil
+	}
+
+	// The change made past minIndex before the watch started is reported
+	if out := recv(); out.ID != alloc2.ID || out.DesiredStatus != models.AllocDesiredStatusPause {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Client updates don't change the desired status
+	update := alloc1.Copy()
+	update.ClientStatus = models.AllocClientStatusRunning
+	if err := state.UpdateAllocsFromClient(1002, []*models.Allocation{update}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case out := <-ch:
+		t.Fatalf("unexpected alloc: %#v", out)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := state.SetAllocDesiredStatus(1003, alloc1.ID, models.AllocDesiredStatusStop); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out := recv(); out.ID != alloc1.ID || out.DesiredStatus != models.AllocDesiredStatusStop {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Cancelling closes the channel
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatalf("channel not closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("channel not closed")
+	}
+}
+
+func TestStateStore_WatchAllocDesiredStatus_Abandon(t *testing.T) {
+	state := testStateStore(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := state.WatchAllocDesiredStatus(ctx, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Abandoning the store closes the channel without cancelling ctx
+	state.Abandon()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatalf("channel not closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("channel not closed")
+	}
+}
+
+func TestStateStore_AllocsByEvalPrefix(t *testing.T) {
+	state := testStateStore(t)
+
+	job := testJob()
+	evalIDs := []string{
+		"11111111-aaaa-bbbb-cccc-000000000001",
+		"11111111-aaaa-bbbb-cccc-000000000002",
+		"22222222-aaaa-bbbb-cccc-000000000001",
+	}
+	var allocs []*models.Allocation
+	for _, evalID := range evalIDs {
+		alloc := testAlloc(job, models.GenerateUUID())
+		alloc.EvalID = evalID
+		allocs = append(allocs, alloc)
+	}
+	if err := state.UpsertAllocs(1000, allocs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	gatherAllocs := func(iter memdb.ResultIterator) []*models.Allocation {
+		var out []*models.Allocation
+		for raw := iter.Next(); raw != nil; raw = iter.Next() {
+			out = append(out, raw.(*models.Allocation))
+		}
+		return out
+	}
+
+	ws := memdb.NewWatchSet()
+	iter, err := state.AllocsByEvalPrefix(ws, "11111111")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := gatherAllocs(iter)
+	if len(out) != 2 {
+		t.Fatalf("bad: %#v", out)
+	}
+	for _, alloc := range out {
+		if alloc.EvalID != evalIDs[0] && alloc.EvalID != evalIDs[1] {
+			t.Fatalf("bad: %#v", alloc)
+		}
+	}
+
+	iter, err = state.AllocsByEvalPrefix(ws, "2222")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out := gatherAllocs(iter); len(out) != 1 || out[0].ID != allocs[2].ID {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// The exact lookup still only matches the full ID
+	exact, err := state.AllocsByEval(ws, evalIDs[0])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(exact) != 1 || exact[0].ID != allocs[0].ID {
+		t.Fatalf("bad: %#v", exact)
+	}
+}
+
+func TestStateStore_RecomputeAllJobStatuses(t *testing.T) {
+	state := testStateStore(t)
+
+	// Restoring bypasses the status computation, leaving stale statuses
+	stale := testJob()
+	stale.Status = models.JobStatusPending
+	paused := testJob()
+	paused.Status = models.JobStatusPause
+	correct := testJob()
+	correct.Status = models.JobStatusPending
+	staleAlloc := testAlloc(stale, models.GenerateUUID())
+	staleAlloc.ClientStatus = models.AllocClientStatusRunning
+	pausedAlloc := testAlloc(paused, models.GenerateUUID())
+	pausedAlloc.ClientStatus = models.AllocClientStatusRunning
+
+	restore, err := state.Restore()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, job := range []*models.Job{stale, paused, correct} {
+		job.CreateIndex, job.ModifyIndex = 1000, 1000
+		if err := restore.JobRestore(job); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for _, alloc := range []*models.Allocation{staleAlloc, pausedAlloc} {
+		alloc.CreateIndex, alloc.ModifyIndex = 1001, 1001
+		if err := restore.AllocRestore(alloc); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := restore.EnsureIndexes(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	restore.Commit()
+
+	ws := memdb.NewWatchSet()
+	if _, err := state.JobByID(ws, stale.ID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	n, err := state.RecomputeAllJobStatuses(1002)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	if !watchFired(ws) {
+		t.Fatalf("bad")
+	}
+
+	expected := map[string]string{
+		stale.ID:   models.JobStatusRunning,
+		paused.ID:  models.JobStatusPause,
+		correct.ID: models.JobStatusPending,
+	}
+	for id, want := range expected {
+		out, err := state.JobByID(nil, id)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out.Status != want {
+			t.Fatalf("bad %s: %#v", id, out)
+		}
+	}
+	if index, _ := state.Index("jobs"); index != 1002 {
+		t.Fatalf("bad: %d", index)
+	}
+
+	// Nothing left to fix
+	if n, err := state.RecomputeAllJobStatuses(1003); err != nil || n != 0 {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+	if index, _ := state.Index("jobs"); index != 1002 {
+		t.Fatalf("bad: %d", index)
+	}
+}